@@ -0,0 +1,168 @@
+// Package block writes native histograms into Prometheus TSDB blocks, using
+// the actual TSDB implementation of Prometheus, and reports the storage cost
+// found in the written blocks.
+package block
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Writer accumulates native histogram samples in a TSDB head and writes them
+// out as a single block upon Flush.
+type Writer struct {
+	dir string
+	w   *tsdb.BlockWriter
+	app storage.Appender
+}
+
+// NewWriter returns a Writer that will write its block into dir. The
+// blockDuration is used as the chunk range of the head, i.e. chunks are cut
+// at multiples of it (in addition to being cut after 120 samples).
+func NewWriter(dir string, blockDuration time.Duration) (*Writer, error) {
+	w, err := tsdb.NewBlockWriter(promslog.NewNopLogger(), dir, blockDuration.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{dir: dir, w: w}, nil
+}
+
+// Labels returns the labels of the series for a metric with the given name and
+// label pairs, as Prometheus would create them upon ingestion.
+func Labels(name string, pairs []*dto.LabelPair) labels.Labels {
+	b := labels.NewScratchBuilder(len(pairs) + 1)
+	b.Add(labels.MetricName, name)
+	for _, lp := range pairs {
+		b.Add(lp.GetName(), lp.GetValue())
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+// Append appends the native part of h as a sample at ts to the series with
+// the given labels. Appended samples only become visible to the block once
+// Commit has been called.
+func (w *Writer) Append(lset labels.Labels, ts time.Time, h *dto.Histogram) error {
+	if w.app == nil {
+		w.app = w.w.Appender(context.Background())
+	}
+	ih, fh := native.ToModel(h)
+	if _, err := w.app.AppendHistogram(0, lset, ts.UnixMilli(), ih, fh); err != nil {
+		return fmt.Errorf("append histogram for %s: %w", lset, err)
+	}
+	return nil
+}
+
+// AppendFloat appends a float sample at ts to the series with the given
+// labels, e.g. for a series of a classic histogram. Like with Append, the
+// sample only becomes visible to the block once Commit has been called.
+func (w *Writer) AppendFloat(lset labels.Labels, ts time.Time, v float64) error {
+	if w.app == nil {
+		w.app = w.w.Appender(context.Background())
+	}
+	if _, err := w.app.Append(0, lset, ts.UnixMilli(), v); err != nil {
+		return fmt.Errorf("append float sample for %s: %w", lset, err)
+	}
+	return nil
+}
+
+// Commit commits all samples appended so far.
+func (w *Writer) Commit() error {
+	if w.app == nil {
+		return nil
+	}
+	err := w.app.Commit()
+	w.app = nil
+	return err
+}
+
+// Flush commits pending samples, writes the block, and returns the directory
+// of the written block. No further samples may be appended afterwards.
+func (w *Writer) Flush() (string, error) {
+	if err := w.Commit(); err != nil {
+		return "", err
+	}
+	id, err := w.w.Flush(context.Background())
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(w.dir, id.String()), nil
+}
+
+// Close releases the resources of the Writer, including its temporary head
+// directory.
+func (w *Writer) Close() error {
+	return w.w.Close()
+}
+
+// SeriesStats contains the actual storage cost of a series within a block.
+type SeriesStats struct {
+	Labels          labels.Labels
+	Chunks, Samples int
+	// Bytes is the sum of the sizes of the encoded chunks, not including
+	// the chunk headers and checksums in the chunk segment files.
+	Bytes int
+}
+
+// ReadStats opens the block in dir and returns the stats of each series in
+// it, in the order of the index.
+func ReadStats(dir string) ([]SeriesStats, error) {
+	b, err := tsdb.OpenBlock(promslog.NewNopLogger(), dir, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	ir, err := b.Index()
+	if err != nil {
+		return nil, err
+	}
+	defer ir.Close()
+	cr, err := b.Chunks()
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	name, value := index.AllPostingsKey()
+	p, err := ir.Postings(context.Background(), name, value)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		stats   []SeriesStats
+		builder labels.ScratchBuilder
+		metas   []chunks.Meta
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &builder, &metas); err != nil {
+			return nil, err
+		}
+		s := SeriesStats{Labels: builder.Labels(), Chunks: len(metas)}
+		for _, meta := range metas {
+			chk, _, err := cr.ChunkOrIterable(meta)
+			if err != nil {
+				return nil, err
+			}
+			if chk == nil {
+				return nil, fmt.Errorf("no chunk found for series %s", s.Labels)
+			}
+			s.Samples += chk.NumSamples()
+			s.Bytes += len(chk.Bytes())
+		}
+		stats = append(stats, s)
+	}
+	return stats, p.Err()
+}
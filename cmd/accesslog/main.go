@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+)
+
+var (
+	input  = flag.String("input", "-", "access log to read, - for stdin")
+	output = flag.String("output", "-", "dataset file to write, - for stdout")
+	format = flag.String("format", "combined", "format of the access log: combined (nginx or Apache combined log format with the request duration appended as the last field) or json (one JSON object per line)")
+	unit   = flag.String("unit", "s", "unit of the request duration in the log: s (nginx $request_time, Apache %T), ms, or us (Apache %D)")
+
+	timeField   = flag.String("time-field", "time", "JSON field with the time stamp of the request")
+	timeLayout  = flag.String("time-layout", time.RFC3339Nano, "Go time layout of the JSON time stamps, or 'unix' for (possibly fractional) seconds since the Unix epoch (RFC3339 is accepted, too)")
+	valueField  = flag.String("value-field", "request_time", "JSON field with the request duration")
+	statusField = flag.String("status-field", "status", "JSON field with the HTTP status code")
+	methodField = flag.String("method-field", "method", "JSON field with the HTTP method")
+	pathField   = flag.String("path-field", "path", "JSON field with the request path")
+
+	statusFilter = flag.String("status", "", "only import requests whose status code matches this regular expression, e.g. '2..'")
+	pathFilter   = flag.String("path", "", "only import requests whose path matches this regular expression")
+	withLabels   labelsFlag
+	anonymize    = flag.Bool("anonymize", false, "replace each path by a salted hash (query strings are always removed)")
+	salt         = flag.String("anonymize-salt", "", "salt for the path hashes of --anonymize, keep it secret to prevent guessing of paths")
+)
+
+func init() {
+	flag.Var(&withLabels, "labels", "comma-separated list of labels to add to each observation, any of method, status, and path")
+}
+
+type labelsFlag []string
+
+func (lf *labelsFlag) String() string {
+	return strings.Join(*lf, ",")
+}
+
+func (lf *labelsFlag) Set(value string) error {
+	*lf = nil
+	for _, name := range strings.Split(value, ",") {
+		switch name {
+		case "method", "status", "path":
+		default:
+			return fmt.Errorf("unknown label %q", name)
+		}
+		*lf = append(*lf, name)
+	}
+	return nil
+}
+
+// request is the part of an access log entry needed for a dataset line.
+type request struct {
+	ts                   time.Time
+	duration             float64 // In seconds.
+	method, status, path string
+}
+
+// combinedRE matches the combined log format, followed by any number of
+// additional fields, of which the last one is the request duration. Referer
+// and user agent are optional (to also match the common log format).
+var combinedRE = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "([^"]*)" (\d{3}) \S+(?: "(?:[^"\\]|\\.)*" "(?:[^"\\]|\\.)*")?(.*)$`)
+
+const combinedLayout = "02/Jan/2006:15:04:05 -0700"
+
+// parseCombined parses a line of an access log in combined log format.
+func parseCombined(line string) (request, error) {
+	m := combinedRE.FindStringSubmatch(line)
+	if m == nil {
+		return request{}, errors.New("not in combined log format")
+	}
+	ts, err := time.Parse(combinedLayout, m[1])
+	if err != nil {
+		return request{}, fmt.Errorf("could not parse time stamp: %w", err)
+	}
+	extra := strings.Fields(m[4])
+	if len(extra) == 0 {
+		return request{}, errors.New("no request duration")
+	}
+	d, err := parseDuration(strings.Trim(extra[len(extra)-1], `"`))
+	if err != nil {
+		return request{}, err
+	}
+	r := request{ts: ts, duration: d, status: m[3]}
+	if fields := strings.Fields(m[2]); len(fields) >= 2 {
+		r.method, r.path = fields[0], stripQuery(fields[1])
+	}
+	return r, nil
+}
+
+// parseJSON parses a line of an access log with one JSON object per line.
+func parseJSON(line string) (request, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return request{}, err
+	}
+	get := func(name string) string {
+		var s string
+		if json.Unmarshal(fields[name], &s) == nil {
+			return s
+		}
+		// Numbers are used verbatim.
+		return string(fields[name])
+	}
+	var (
+		r   = request{method: get(*methodField), status: get(*statusField), path: stripQuery(get(*pathField))}
+		err error
+	)
+	ts := get(*timeField)
+	if *timeLayout == "unix" {
+		r.ts, err = dataset.ParseTimestamp(ts)
+	} else {
+		r.ts, err = time.Parse(*timeLayout, ts)
+	}
+	if err != nil {
+		return request{}, fmt.Errorf("could not parse time stamp: %w", err)
+	}
+	if r.duration, err = parseDuration(get(*valueField)); err != nil {
+		return request{}, err
+	}
+	return r, nil
+}
+
+// stripQuery removes the query string from path.
+func stripQuery(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	return path
+}
+
+// parseDuration parses a request duration in --unit and returns it in
+// seconds.
+func parseDuration(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse request duration %q", s)
+	}
+	switch *unit {
+	case "ms":
+		v /= 1e3
+	case "us":
+		v /= 1e6
+	}
+	return v, nil
+}
+
+// anonymizePath returns the first 12 hex digits of the salted SHA-256 hash of
+// path.
+func anonymizePath(path string) string {
+	sum := sha256.Sum256([]byte(*salt + path))
+	return "/" + hex.EncodeToString(sum[:6])
+}
+
+// observation returns the dataset observation for r, with the labels in
+// --labels. Spaces in label values are escaped, as they would break the
+// dataset line.
+func (r request) observation() dataset.Observation {
+	o := dataset.Observation{Timestamp: r.ts, Value: r.duration, Weight: 1}
+	if len(withLabels) > 0 {
+		o.Labels = map[string]string{}
+		values := map[string]string{"method": r.method, "status": r.status, "path": r.path}
+		for _, l := range withLabels {
+			o.Labels[l] = strings.ReplaceAll(values[l], " ", "%20")
+		}
+	}
+	return o
+}
+
+func main() {
+	flag.Parse()
+
+	var parse func(string) (request, error)
+	switch *format {
+	case "combined":
+		parse = parseCombined
+	case "json":
+		parse = parseJSON
+	default:
+		log.Fatalln("--format must be combined or json, provided value:", *format)
+	}
+	switch *unit {
+	case "s", "ms", "us":
+	default:
+		log.Fatalln("--unit must be s, ms, or us, provided value:", *unit)
+	}
+	statusRE, err := regexp.Compile("^(?:" + *statusFilter + ")$")
+	if err != nil {
+		log.Fatalln("Invalid --status:", err)
+	}
+	pathRE, err := regexp.Compile(*pathFilter)
+	if err != nil {
+		log.Fatalln("Invalid --path:", err)
+	}
+
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalln("Could not open access log:", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln("Could not create dataset file:", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	var (
+		s                         = bufio.NewScanner(in)
+		lines, written, malformed int
+		filtered, outOfOrder      int
+		last                      time.Time
+	)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		lines++
+		r, err := parse(s.Text())
+		if err != nil {
+			malformed++
+			if malformed <= 10 {
+				log.Printf("Skipping malformed line %d: %v", lines, err)
+			}
+			continue
+		}
+		if *statusFilter != "" && !statusRE.MatchString(r.status) || !pathRE.MatchString(r.path) {
+			filtered++
+			continue
+		}
+		if r.ts.Before(last) {
+			outOfOrder++
+		}
+		last = r.ts
+		if *anonymize {
+			r.path = anonymizePath(r.path)
+		}
+
+		if _, err := fmt.Fprintln(w, r.observation()); err != nil {
+			log.Fatalln("Could not write dataset:", err)
+		}
+		written++
+	}
+	if err := s.Err(); err != nil {
+		log.Fatalln("Could not read access log:", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalln("Could not write dataset:", err)
+	}
+	log.Printf(
+		"Read %d lines, wrote %d observations, skipped %d malformed and %d filtered lines.",
+		lines, written, malformed, filtered,
+	)
+	if outOfOrder > 0 {
+		log.Println("Warning:", outOfOrder, "requests are older than the request before them, consider sorting the dataset.")
+	}
+}
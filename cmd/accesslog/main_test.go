@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setFlag sets the flag variable p to v for the duration of the test.
+func setFlag(t *testing.T, p *string, v string) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestParseCombined(t *testing.T) {
+	ts := time.Date(2019, 9, 18, 19, 19, 8, 0, time.FixedZone("", 2*3600))
+	scenarios := []struct {
+		name, unit, line string
+		want             request
+		wantErr          bool
+	}{
+		{
+			name: "nginx with query string",
+			unit: "s",
+			line: `192.168.1.1 - - [18/Sep/2019:19:19:08 +0200] "GET /api/v1/query?query=up HTTP/1.1" 200 1234 "-" "curl/7.64.0" 0.123`,
+			want: request{ts: ts, duration: 0.123, method: "GET", status: "200", path: "/api/v1/query"},
+		},
+		{
+			name: "Apache %D in microseconds",
+			unit: "us",
+			line: `10.0.0.1 - frank [18/Sep/2019:19:19:08 +0200] "POST /submit HTTP/1.1" 201 12 "https://example.org/" "Mozilla/5.0 (X11; \"quoted\")" 123456`,
+			want: request{ts: ts, duration: 0.123456, method: "POST", status: "201", path: "/submit"},
+		},
+		{
+			name: "common log format with quoted duration",
+			unit: "ms",
+			line: `10.0.0.1 - - [18/Sep/2019:19:19:08 +0200] "GET / HTTP/1.0" 404 - "250"`,
+			want: request{ts: ts, duration: 0.25, method: "GET", status: "404", path: "/"},
+		},
+		{
+			name:    "no duration",
+			unit:    "s",
+			line:    `10.0.0.1 - - [18/Sep/2019:19:19:08 +0200] "GET / HTTP/1.0" 200 12 "-" "curl/7.64.0"`,
+			wantErr: true,
+		},
+		{
+			name:    "bad time stamp",
+			unit:    "s",
+			line:    `10.0.0.1 - - [18/Sep/2019 19:19:08] "GET / HTTP/1.0" 200 12 0.1`,
+			wantErr: true,
+		},
+		{
+			name:    "bad duration",
+			unit:    "s",
+			line:    `10.0.0.1 - - [18/Sep/2019:19:19:08 +0200] "GET / HTTP/1.0" 200 12 fast`,
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			unit:    "s",
+			line:    `this is not an access log`,
+			wantErr: true,
+		},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			setFlag(t, unit, s.unit)
+			got, err := parseCombined(s.line)
+			if s.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.ts.Equal(s.want.ts) {
+				t.Errorf("got time stamp %v, want %v", got.ts, s.want.ts)
+			}
+			got.ts = s.want.ts
+			if got != s.want {
+				t.Errorf("got %+v, want %+v", got, s.want)
+			}
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	setFlag(t, timeField, "@timestamp")
+	setFlag(t, timeLayout, "unix")
+	setFlag(t, valueField, "duration_ms")
+	setFlag(t, statusField, "code")
+	setFlag(t, methodField, "verb")
+	setFlag(t, pathField, "uri")
+	setFlag(t, unit, "ms")
+
+	scenarios := []struct {
+		name, line string
+		want       request
+		wantErr    bool
+	}{
+		{
+			name: "custom fields with numbers",
+			line: `{"@timestamp": 1568827148.123456789, "duration_ms": 12.5, "code": 200, "verb": "GET", "uri": "/search?q=secret"}`,
+			want: request{ts: time.Unix(1568827148, 123456789), duration: 0.0125, method: "GET", status: "200", path: "/search"},
+		},
+		{
+			name: "custom fields with strings",
+			line: `{"@timestamp": "1568827148", "duration_ms": "3", "code": "503", "verb": "PUT", "uri": "/items/1", "other": true}`,
+			want: request{ts: time.Unix(1568827148, 0), duration: 0.003, method: "PUT", status: "503", path: "/items/1"},
+		},
+		{
+			name: "RFC3339 time stamp",
+			line: `{"@timestamp": "2019-09-18T17:19:08Z", "duration_ms": 1}`,
+			want: request{ts: time.Unix(1568827148, 0), duration: 0.001},
+		},
+		{
+			name:    "missing duration",
+			line:    `{"@timestamp": 1568827148, "code": 200}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad time stamp",
+			line:    `{"@timestamp": "yesterday", "duration_ms": 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			line:    `{"@timestamp": 1568827148, "duration_ms":`,
+			wantErr: true,
+		},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			got, err := parseJSON(s.line)
+			if s.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.ts.Equal(s.want.ts) {
+				t.Errorf("got time stamp %v, want %v", got.ts, s.want.ts)
+			}
+			got.ts = s.want.ts
+			if got != s.want {
+				t.Errorf("got %+v, want %+v", got, s.want)
+			}
+		})
+	}
+}
+
+func TestObservation(t *testing.T) {
+	old := withLabels
+	withLabels = labelsFlag{"path", "method"}
+	defer func() { withLabels = old }()
+
+	r := request{ts: time.Unix(1568827148, 5e8).UTC(), duration: 0.25, method: "GET", status: "200", path: "/a b"}
+	if got, want := r.observation().String(), "2019-09-18T17:19:08.5Z 0.25 method=GET path=/a%20b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
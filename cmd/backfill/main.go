@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/beorn7/histogram_experiments/block"
+	"github.com/beorn7/histogram_experiments/dataset"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	datasetFile    = flag.String("dataset", "", "input file to read dataset from")
+	outputDir      = flag.String("output-dir", "data", "directory to write the TSDB blocks into, e.g. the storage.tsdb.path of a local Prometheus")
+	metricName     = flag.String("metric-name", "histogram_experiment", "name of the histogram (and thus the resulting series)")
+	factor         = flag.Float64("factor", 1.1, "each bucket is by this factor wider than the previous one, must be greater 1")
+	zeroThreshold  = flag.Float64("zero-threshold", 1e-128, "width of the “zero” bucket")
+	scrapeInterval = flag.Duration("scrape-interval", 15*time.Second, "interval of the virtual scrapes, in dataset time")
+	blockDuration  = flag.Duration("block-duration", 24*time.Hour, "time range covered by each written block, blocks are aligned to multiples of it")
+)
+
+// backfiller performs virtual scrapes of a histogram and writes the results
+// into TSDB blocks, one block per block duration.
+type backfiller struct {
+	his  prometheus.Histogram
+	w    *block.Writer
+	end  time.Time // End of the time range of the current block.
+	lset labels.Labels
+
+	blocks, samples, bytes int
+}
+
+// scrape takes a virtual scrape at ts.
+func (b *backfiller) scrape(ts time.Time) {
+	if !ts.Before(b.end) {
+		b.flush()
+	}
+	if b.w == nil {
+		var err error
+		if b.w, err = block.NewWriter(*outputDir, *blockDuration); err != nil {
+			log.Fatalln("Could not create block writer:", err)
+		}
+		b.end = ts.Truncate(*blockDuration).Add(*blockDuration)
+	}
+	var m dto.Metric
+	if err := b.his.Write(&m); err != nil {
+		log.Fatalln("Could not scrape histogram:", err)
+	}
+	if err := b.w.Append(b.lset, ts, m.GetHistogram()); err != nil {
+		log.Fatalln("Could not append scraped histogram:", err)
+	}
+}
+
+// flush writes the current block, if any.
+func (b *backfiller) flush() {
+	if b.w == nil {
+		return
+	}
+	defer func() { b.w.Close(); b.w = nil }()
+	dir, err := b.w.Flush()
+	if err != nil {
+		log.Fatalln("Could not write block:", err)
+	}
+	stats, err := block.ReadStats(dir)
+	if err != nil {
+		log.Fatalln("Could not read written block:", err)
+	}
+	b.blocks++
+	for _, s := range stats {
+		b.samples += s.Samples
+		b.bytes += s.Bytes
+		log.Printf("Wrote block %s: %d samples in %d chunks, %d chunk bytes.", dir, s.Samples, s.Chunks, s.Bytes)
+	}
+}
+
+func backfill(in io.Reader) {
+	var (
+		b = &backfiller{
+			his: prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name:                         *metricName,
+				Help:                         "Test histogram for an experiment.",
+				NativeHistogramBucketFactor:  *factor,
+				NativeHistogramZeroThreshold: *zeroThreshold,
+			}),
+			lset: block.Labels(*metricName, nil),
+		}
+		r          = dataset.NewReader(in)
+		count      = 0
+		start      = time.Now()
+		nextScrape time.Time
+	)
+
+	for {
+		o, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalln("Could not read dataset:", err)
+		}
+		if nextScrape.IsZero() {
+			nextScrape = o.Timestamp.Truncate(*scrapeInterval).Add(*scrapeInterval)
+		}
+		for !o.Timestamp.Before(nextScrape) {
+			b.scrape(nextScrape)
+			nextScrape = nextScrape.Add(*scrapeInterval)
+		}
+		for i := uint64(0); i < o.Weight; i++ {
+			b.his.Observe(o.Value)
+		}
+		count += int(o.Weight)
+	}
+	if count > 0 {
+		// One final scrape to include the last observations.
+		b.scrape(nextScrape)
+	}
+	b.flush()
+	log.Println("Performed", count, "observations in", time.Since(start), ".")
+	if b.samples == 0 {
+		log.Println("No samples written.")
+		return
+	}
+	log.Printf(
+		"Wrote %d blocks with %d samples and %d chunk bytes in total (%.1f bytes per sample).",
+		b.blocks, b.samples, b.bytes, float64(b.bytes)/float64(b.samples),
+	)
+}
+
+func main() {
+	flag.Parse()
+	if *factor <= 1 {
+		log.Fatalln("--factor must by greater than 1, provided value:", *factor)
+	}
+	if *scrapeInterval <= 0 || *blockDuration < *scrapeInterval {
+		log.Fatalln("--scrape-interval must be positive and not longer than --block-duration")
+	}
+
+	f, err := dataset.Open(*datasetFile, false)
+	if err != nil {
+		log.Fatalln("Could not open dataset file:", err)
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(*outputDir, 0o777); err != nil {
+		log.Fatalln("Could not create output directory:", err)
+	}
+	backfill(f)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+	"github.com/beorn7/histogram_experiments/native"
+)
+
+var (
+	format       = flag.String("format", "text", "format of the datasets: text, csv, or jsonl (see the exposer)")
+	rateInterval = flag.Duration("rate-interval", 0, "length of the intervals to report the rate of observations for, 0 means a tenth of the time range of the dataset")
+	mapping      = dataset.DefaultMapping
+	quantiles    = floatsFlag{0.5, 0.9, 0.99, 0.999}
+	thresholds   = floatsFlag{0, 1e-6, 1e-3}
+)
+
+func init() {
+	flag.StringVar(&mapping.Timestamp, "timestamp-field", mapping.Timestamp, "name of the CSV column or JSON field with the time stamp")
+	flag.StringVar(&mapping.Value, "value-field", mapping.Value, "name of the CSV column or JSON field with the observed value")
+	flag.StringVar(&mapping.Weight, "weight-field", mapping.Weight, "name of the CSV column or JSON field with the weight of the observation")
+	flag.Var(&quantiles, "quantiles", "comma-separated list of quantiles to calculate exactly")
+	flag.Var(&thresholds, "zero-thresholds", "comma-separated list of zero thresholds to report the number of populated native buckets for")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] DATASET...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+type floatsFlag []float64
+
+func (ff *floatsFlag) String() string {
+	return fmt.Sprint(*ff)
+}
+
+func (ff *floatsFlag) Set(value string) error {
+	*ff = nil
+	for _, ft := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(ft, 64)
+		if err != nil {
+			return err
+		}
+		*ff = append(*ff, f)
+	}
+	return nil
+}
+
+// sample is an observed value with its weight.
+type sample struct {
+	v float64
+	w uint64
+}
+
+// stats are the statistics of a dataset, apart from those calculated from the
+// sorted samples.
+type stats struct {
+	lines, outOfOrder int
+	count, nan        uint64
+	first, last       time.Time
+	times             []time.Time // Of each line, for the rate over time.
+	weights           []uint64
+}
+
+// read reads the dataset from in.
+func read(in io.Reader) (stats, []sample) {
+	r, err := dataset.NewSource(in, *format, mapping)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var (
+		s       stats
+		samples []sample
+	)
+	for {
+		o, err := r.Read()
+		if err == io.EOF {
+			return s, samples
+		}
+		if err != nil {
+			log.Fatalln("Could not read dataset:", err)
+		}
+		s.lines++
+		s.count += o.Weight
+		if s.first.IsZero() || o.Timestamp.Before(s.first) {
+			s.first = o.Timestamp
+		}
+		if o.Timestamp.Before(s.last) {
+			s.outOfOrder++
+		}
+		if o.Timestamp.After(s.last) {
+			s.last = o.Timestamp
+		}
+		s.times = append(s.times, o.Timestamp)
+		s.weights = append(s.weights, o.Weight)
+		if math.IsNaN(o.Value) {
+			s.nan += o.Weight
+			continue
+		}
+		samples = append(samples, sample{o.Value, o.Weight})
+	}
+}
+
+// report prints the statistics of a dataset. The samples must be sorted by
+// value and must not contain NaN.
+func report(s stats, samples []sample) {
+	if s.count == 0 {
+		fmt.Println("No observations.")
+		return
+	}
+	span := s.last.Sub(s.first)
+	fmt.Printf("Observations: %d in %d lines", s.count, s.lines)
+	if s.outOfOrder > 0 {
+		fmt.Printf(" (%d out of chronological order)", s.outOfOrder)
+	}
+	fmt.Println()
+	fmt.Printf("Time range: %s to %s (%s)\n", s.first.Format(time.RFC3339Nano), s.last.Format(time.RFC3339Nano), span)
+	if span > 0 {
+		fmt.Printf("Average rate: %.4g/s\n", float64(s.count)/span.Seconds())
+	}
+
+	if s.nan > 0 {
+		fmt.Printf("NaN values: %d (ignored below)\n", s.nan)
+	}
+	count := s.count - s.nan
+	if count == 0 {
+		return
+	}
+	var (
+		sum             float64
+		negative, zeros uint64
+	)
+	for _, smp := range samples {
+		sum += smp.v * float64(smp.w)
+		switch {
+		case smp.v < 0:
+			negative += smp.w
+		case smp.v == 0:
+			zeros += smp.w
+		}
+	}
+	// Samples with weight 0 have not been observed.
+	var lo, hi float64
+	for _, smp := range samples {
+		if smp.w > 0 {
+			lo = smp.v
+			break
+		}
+	}
+	for i := len(samples) - 1; i >= 0; i-- {
+		if samples[i].w > 0 {
+			hi = samples[i].v
+			break
+		}
+	}
+	fmt.Printf("Min: %g, max: %g, mean: %g\n", lo, hi, sum/float64(count))
+	fmt.Printf(
+		"Negative values: %.2f%%, zero values: %.2f%%\n",
+		100*float64(negative)/float64(count), 100*float64(zeros)/float64(count),
+	)
+	for _, q := range quantiles {
+		fmt.Printf("q=%g: %g\n", q, exactQuantile(q, count, samples))
+	}
+
+	if span > 0 {
+		reportRate(s)
+	}
+	reportBuckets(samples)
+}
+
+// exactQuantile returns the q-quantile of the sorted samples using the
+// nearest-rank method.
+func exactQuantile(q float64, count uint64, samples []sample) float64 {
+	rank := uint64(math.Ceil(q * float64(count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var cum uint64
+	for _, smp := range samples {
+		cum += smp.w
+		if cum >= rank {
+			return smp.v
+		}
+	}
+	return samples[len(samples)-1].v
+}
+
+// reportRate prints the rate of observations per --rate-interval. The time
+// range of the dataset must not be empty.
+func reportRate(s stats) {
+	span := s.last.Sub(s.first)
+	interval := *rateInterval
+	if interval <= 0 {
+		interval = max(span/10, time.Second).Round(time.Second)
+	}
+	// The last observation is counted in the last interval, even if it is
+	// right at its end.
+	n := int((span + interval - 1) / interval)
+	counts := make([]uint64, n)
+	for i, ts := range s.times {
+		counts[min(int(ts.Sub(s.first)/interval), n-1)] += s.weights[i]
+	}
+	fmt.Printf("Rate per %s:\n", interval)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for i, c := range counts {
+		fmt.Fprintf(w, "  %s\t%.4g/s\t\n", s.first.Add(time.Duration(i)*interval).Format(time.RFC3339), float64(c)/interval.Seconds())
+	}
+	w.Flush()
+}
+
+// reportBuckets prints the number of native buckets (including the zero
+// bucket, if populated) the sorted samples populate for each schema and each
+// of the --zero-thresholds. As bucket indices are monotonic in the value,
+// it's sufficient to count the index changes between consecutive samples.
+// Infinite values are not counted.
+func reportBuckets(samples []sample) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Println("Populated native buckets:")
+	fmt.Fprint(w, "  schema\tfactor\t")
+	for _, zt := range thresholds {
+		fmt.Fprintf(w, "zt=%g\t", zt)
+	}
+	fmt.Fprintln(w)
+	for schema := int32(native.MaxSchema); schema >= native.MinSchema; schema-- {
+		fmt.Fprintf(w, "  %d\t%.5g\t", schema, math.Exp2(math.Exp2(-float64(schema))))
+		for _, zt := range thresholds {
+			fmt.Fprintf(w, "%d\t", countBuckets(samples, schema, zt))
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+func countBuckets(samples []sample, schema int32, zt float64) int {
+	var (
+		n        int
+		zero     bool
+		prevIdx  int32
+		prevSign = 0
+	)
+	for _, smp := range samples {
+		v := smp.v
+		if smp.w == 0 || math.IsInf(v, 0) {
+			continue
+		}
+		if math.Abs(v) <= zt {
+			zero = true
+			continue
+		}
+		sign := 1
+		if v < 0 {
+			sign = -1
+		}
+		idx := native.Index(v, schema)
+		if sign != prevSign || idx != prevIdx {
+			n++
+		}
+		prevSign, prevIdx = sign, idx
+	}
+	if zero {
+		n++
+	}
+	return n
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	for _, q := range quantiles {
+		if q < 0 || q > 1 {
+			log.Fatalln("--quantiles must be between 0 and 1, provided value:", q)
+		}
+	}
+
+	for i, name := range flag.Args() {
+		f, err := dataset.Open(name, false)
+		if err != nil {
+			log.Fatalln("Could not open dataset file:", err)
+		}
+		s, samples := read(f)
+		f.Close()
+		sort.Slice(samples, func(i, j int) bool { return samples[i].v < samples[j].v })
+
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("## %s\n", name)
+		report(s, samples)
+	}
+}
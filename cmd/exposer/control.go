@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// control steers a replay, as requested via the HTTP control API, and keeps
+// track of the replay's position for the status endpoint.
+//
+// The replay calls wait before each observation. It returns early whenever
+// the control changes, so that the replay can act on pending commands (see
+// take).
+type control struct {
+	mu sync.Mutex
+	// changed is closed (and replaced) upon each change.
+	changed chan struct{}
+
+	paused     bool
+	timeFactor float64
+	// Anchors of the time simulation. Changing the time factor, resuming,
+	// and seeking re-anchors the simulation at the next observation.
+	simAnchor, wallAnchor time.Time
+
+	// Pending commands.
+	seek           time.Time
+	restart, reset bool
+
+	// Position of the replay.
+	line      int
+	count     int
+	simulated time.Time
+	done      bool
+}
+
+func newControl(timeFactor float64) *control {
+	return &control{changed: make(chan struct{}), timeFactor: timeFactor}
+}
+
+// change applies f while holding the lock and notifies the replay.
+func (c *control) change(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f()
+	c.simAnchor = time.Time{}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// command is a set of pending commands, see take.
+type command struct {
+	seek           time.Time
+	restart, reset bool
+}
+
+// take returns and clears the pending commands.
+func (c *control) take() command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := command{seek: c.seek, restart: c.restart, reset: c.reset}
+	c.seek, c.restart, c.reset = time.Time{}, false, false
+	return cmd
+}
+
+// wait blocks until it is time to perform an observation with the simulated
+// time stamp ts. It returns false if it has been interrupted by a change, in
+// which case pending commands have to be taken before calling it again.
+// Otherwise, it returns the lag of the replay, i.e. the desired minus the
+// current wall-clock offset relative to the anchors before waiting, which is
+// negative if the replay falls behind the simulated clock.
+func (c *control) wait(ts time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	ch := c.changed
+	if !c.seek.IsZero() || c.restart || c.reset {
+		c.mu.Unlock()
+		return 0, false
+	}
+	if c.paused {
+		c.mu.Unlock()
+		<-ch
+		return 0, false
+	}
+	if c.timeFactor <= 0 {
+		c.mu.Unlock()
+		return 0, true
+	}
+	if c.simAnchor.IsZero() {
+		c.simAnchor, c.wallAnchor = ts, time.Now()
+	}
+	d := time.Duration(float64(ts.Sub(c.simAnchor))/c.timeFactor) - time.Since(c.wallAnchor)
+	c.mu.Unlock()
+	if d <= 0 {
+		return d, true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return d, true
+	case <-ch:
+		return 0, false
+	}
+}
+
+// waitForCommand blocks at the end of the dataset until there is a pending
+// command.
+func (c *control) waitForCommand() {
+	for {
+		c.mu.Lock()
+		ch := c.changed
+		pending := !c.seek.IsZero() || c.restart || c.reset
+		c.mu.Unlock()
+		if pending {
+			return
+		}
+		<-ch
+	}
+}
+
+// setPosition records the position of the replay.
+func (c *control) setPosition(line, count int, simulated time.Time, done bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.line, c.count, c.simulated, c.done = line, count, simulated, done
+}
+
+// replayStatus is the JSON representation of the status of a replay.
+type replayStatus struct {
+	Replay        string    `json:"replay"`
+	State         string    `json:"state"`
+	Line          int       `json:"line"`
+	Observations  int       `json:"observations"`
+	SimulatedTime time.Time `json:"simulated_time"`
+	TimeFactor    float64   `json:"time_factor"`
+}
+
+func (c *control) status(name string) replayStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := replayStatus{
+		Replay: name, State: "running",
+		Line: c.line, Observations: c.count, SimulatedTime: c.simulated, TimeFactor: c.timeFactor,
+	}
+	switch {
+	case c.done:
+		s.State = "done"
+	case c.paused:
+		s.State = "paused"
+	}
+	return s
+}
+
+// controlHandler serves the HTTP control API for the replays. Commands are
+// POST requests to /replay/pause, /replay/resume, /replay/time-factor?value=F,
+// /replay/seek?time=RFC3339, /replay/restart (from the beginning of the
+// dataset), and /replay/reset (of the histograms). GET /replay/status returns
+// the status of the replays as JSON. All commands apply to all replays, unless
+// restricted to those of one dataset with the dataset parameter.
+func controlHandler(replays []replay) http.Handler {
+	mux := http.NewServeMux()
+	command := func(path string, f func(r *http.Request) (func(*control), error)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			apply, err := f(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			n := 0
+			for _, rp := range replays {
+				if ds := r.FormValue("dataset"); ds != "" && ds != rp.dataset {
+					continue
+				}
+				rp.ctl.change(func() { apply(rp.ctl) })
+				n++
+			}
+			if n == 0 {
+				http.Error(w, "no matching replay", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(w, "OK, applied to", n, "replays.")
+		})
+	}
+	command("/replay/pause", func(*http.Request) (func(*control), error) {
+		return func(c *control) { c.paused = true }, nil
+	})
+	command("/replay/resume", func(*http.Request) (func(*control), error) {
+		return func(c *control) { c.paused = false }, nil
+	})
+	command("/replay/time-factor", func(r *http.Request) (func(*control), error) {
+		f, err := strconv.ParseFloat(r.FormValue("value"), 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid time factor %q", r.FormValue("value"))
+		}
+		return func(c *control) { c.timeFactor = f }, nil
+	})
+	command("/replay/seek", func(r *http.Request) (func(*control), error) {
+		ts, err := time.Parse(time.RFC3339Nano, r.FormValue("time"))
+		if err != nil {
+			return nil, err
+		}
+		return func(c *control) { c.seek = ts }, nil
+	})
+	command("/replay/restart", func(*http.Request) (func(*control), error) {
+		return func(c *control) { c.restart = true }, nil
+	})
+	command("/replay/reset", func(*http.Request) (func(*control), error) {
+		return func(c *control) { c.reset = true }, nil
+	})
+	mux.HandleFunc("/replay/status", func(w http.ResponseWriter, r *http.Request) {
+		var statuses []replayStatus
+		for _, rp := range replays {
+			if ds := r.FormValue("dataset"); ds != "" && ds != rp.dataset {
+				continue
+			}
+			statuses = append(statuses, rp.ctl.status(rp.name))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(statuses)
+	})
+	return mux
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+)
+
+// splitter distributes observations over a number of simulated instances,
+// each with its own histogram, as a load balancer would distribute requests
+// over the instances of a service.
+type splitter struct {
+	vec    prometheus.ObserverVec
+	n      int
+	byHash bool
+}
+
+// newSplitter returns a splitter distributing observations over n instances
+// of vec (labeled "0" to "n-1" via its instance label), either randomly or by
+// a hash of the observation.
+func newSplitter(vec prometheus.ObserverVec, n int, strategy string) (*splitter, error) {
+	s := &splitter{vec: vec, n: n}
+	switch strategy {
+	case "random":
+	case "hash":
+		s.byHash = true
+	default:
+		return nil, fmt.Errorf("unknown split strategy %q", strategy)
+	}
+	return s, nil
+}
+
+// create creates the histograms of all instances for the given labels, without
+// observing anything.
+func (s *splitter) create(labels prometheus.Labels) {
+	for i := 0; i < s.n; i++ {
+		s.vec.With(s.withInstance(i, labels))
+	}
+}
+
+// withInstance returns labels with the instance label for instance i added.
+func (s *splitter) withInstance(i int, labels prometheus.Labels) prometheus.Labels {
+	withInstance := prometheus.Labels{"instance": fmt.Sprint(i)}
+	for name, value := range labels {
+		withInstance[name] = value
+	}
+	return withInstance
+}
+
+// observe performs o on one of the instances of the histogram with the given
+// labels (the instance label is added).
+func (s *splitter) observe(o dataset.Observation, labels prometheus.Labels) {
+	i := 0
+	if s.byHash {
+		var buf [16]byte
+		binary.LittleEndian.PutUint64(buf[:8], uint64(o.Timestamp.UnixNano()))
+		binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(o.Value))
+		h := fnv.New64a()
+		h.Write(buf[:])
+		i = int(h.Sum64() % uint64(s.n))
+	} else {
+		i = rand.Intn(s.n)
+	}
+	s.vec.With(s.withInstance(i, labels)).Observe(o.Value)
+}
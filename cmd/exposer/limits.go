@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// limitTracker watches a native histogram for the effects of the bucket
+// limiting strategies of client_golang, i.e. a reset of the whole histogram, a
+// widening of the zero bucket, or a reduction of the resolution. Each event is
+// logged together with the dataset line and the simulated time stamp of the
+// observation that triggered it, so that runs with different strategies can be
+// compared on the same dataset.
+//
+// The strategies only ever kick in if an observation creates a new bucket. To
+// avoid the cost of writing out the histogram after every observation, the
+// tracker keeps its own record of the populated buckets and only inspects the
+// histogram if an observation has ended up in a bucket not seen before.
+type limitTracker struct {
+	his    prometheus.Histogram
+	logger *log.Logger
+
+	// State as seen during the last inspection of the histogram.
+	schema        int32
+	zeroThreshold float64
+	// Expected sample count of the histogram after the last observation.
+	count uint64
+	// Keys of the populated positive and negative buckets.
+	positive, negative map[int32]struct{}
+
+	resets, widenings, downscalings int
+}
+
+func newLimitTracker(his prometheus.Histogram, logger *log.Logger) *limitTracker {
+	t := &limitTracker{his: his, logger: logger}
+	t.sync(t.write())
+	return t
+}
+
+// track has to be called after each observation of v.
+func (t *limitTracker) track(v float64, ts time.Time, line int) {
+	t.count++
+	if !t.isNewBucket(v) {
+		return
+	}
+	h := t.write()
+	changed := false
+	if h.GetSampleCount() < t.count {
+		t.resets++
+		changed = true
+		t.logger.Printf("Histogram reset at %s (line %d), sample count before reset: %d", ts.Format(time.RFC3339Nano), line, t.count-1)
+	}
+	if h.GetZeroThreshold() > t.zeroThreshold {
+		t.widenings++
+		changed = true
+		t.logger.Printf("Zero bucket widened at %s (line %d): %g → %g", ts.Format(time.RFC3339Nano), line, t.zeroThreshold, h.GetZeroThreshold())
+	}
+	if h.GetSchema() < t.schema {
+		t.downscalings++
+		changed = true
+		t.logger.Printf("Resolution reduced at %s (line %d): schema %d → %d", ts.Format(time.RFC3339Nano), line, t.schema, h.GetSchema())
+	}
+	if changed {
+		t.sync(h)
+	}
+}
+
+// report logs the number of events seen so far.
+func (t *limitTracker) report() {
+	t.logger.Println(
+		"Bucket limiting:", t.resets, "resets,", t.widenings, "zero bucket widenings,", t.downscalings, "resolution reductions.",
+		"Final schema:", t.schema, "final zero threshold:", t.zeroThreshold,
+	)
+}
+
+func (t *limitTracker) write() *dto.Histogram {
+	var m dto.Metric
+	if err := t.his.Write(&m); err != nil {
+		t.logger.Fatalln("Could not inspect histogram:", err)
+	}
+	return m.GetHistogram()
+}
+
+// sync resets the tracked state to the state of h.
+func (t *limitTracker) sync(h *dto.Histogram) {
+	t.schema = h.GetSchema()
+	t.zeroThreshold = h.GetZeroThreshold()
+	t.count = h.GetSampleCount()
+	t.positive = bucketKeys(h.GetPositiveSpan())
+	t.negative = bucketKeys(h.GetNegativeSpan())
+}
+
+// isNewBucket returns true if v has been observed into a bucket that wasn't
+// populated before (and records it as populated now).
+func (t *limitTracker) isNewBucket(v float64) bool {
+	if math.IsNaN(v) || math.Abs(v) <= t.zeroThreshold {
+		return false
+	}
+	keys := t.positive
+	if v < 0 {
+		keys = t.negative
+	}
+	key := native.Index(v, t.schema)
+	if _, ok := keys[key]; ok {
+		return false
+	}
+	keys[key] = struct{}{}
+	return true
+}
+
+func bucketKeys(spans []*dto.BucketSpan) map[int32]struct{} {
+	var (
+		keys = map[int32]struct{}{}
+		idx  int32
+	)
+	for _, span := range spans {
+		idx += span.GetOffset()
+		for end := idx + int32(span.GetLength()); idx < end; idx++ {
+			keys[idx] = struct{}{}
+		}
+	}
+	return keys
+}
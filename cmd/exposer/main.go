@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -14,81 +14,485 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+	"github.com/beorn7/histogram_experiments/native"
+	"github.com/beorn7/histogram_experiments/otlp"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
-	addr          = flag.String("listen-address", ":8080", "address to listen on for HTTP requests")
-	dataset       = flag.String("dataset", "", "input file to read datasat from")
-	factor        = flag.Float64("factor", 1.1, "each bucket is by this factor wider than the previous one, must be greater 1")
-	zeroThreshold = flag.Float64("zero-threshold", 1e-128, "width of the “zero” bucket")
-	timeFactor    = flag.Float64("time-factor", 0, "how fast to run the time simulation, 0 results in ingesting all observations as fast as possible")
+	addr       = flag.String("listen-address", ":8080", "address to listen on for HTTP requests")
+	timeFactor = flag.Float64("time-factor", 0, "how fast to run the time simulation, 0 results in ingesting all observations as fast as possible (can be changed via the control API, see /replay/time-factor)")
+
+	maxBucketNumber  = flag.Uint("max-bucket-number", 0, "maximum number of populated buckets before the bucket limiting strategy kicks in, 0 means no limit")
+	minResetDuration = flag.Duration("min-reset-duration", 0, "reset the histogram upon hitting --max-bucket-number if the last reset is at least this long ago, 0 means never reset (note that this is wall-clock time, not simulated time)")
+	maxZeroThreshold = flag.Float64("max-zero-threshold", 0, "widen the “zero” bucket up to this threshold upon hitting --max-bucket-number before reducing the resolution")
+
+	otlpEndpoint    = flag.String("otlp-endpoint", "", "if set, push the histogram as an OTLP exponential histogram to this OTLP/HTTP URL, e.g. http://localhost:4318/v1/metrics")
+	otlpInterval    = flag.Duration("otlp-interval", 15*time.Second, "interval between OTLP pushes (wall-clock time)")
+	otlpTemporality = flag.String("otlp-temporality", "cumulative", "aggregation temporality of the pushed OTLP data points, cumulative or delta")
+	otlpReceiver    = flag.Bool("otlp-receiver", false, "also act as a stand-in OTLP receiver on /v1/metrics, logging the size of received requests")
+
+	instances = flag.Int("instances", 1, "if greater than 1, additionally split the observations over this many simulated instances, each exposed as a histogram with an instance label")
+	split     = flag.String("split", "hash", "how to split observations over instances, random or hash (of time stamp and value, which is deterministic)")
+
+	loop           = flag.Bool("loop", false, "replay the datasets endlessly, shifting the time stamps of each pass to follow the previous pass")
+	resetInterval  = flag.Duration("reset-interval", 0, "reset the histograms after this duration of simulated time, 0 means never")
+	resetAfter     = flag.Int("reset-after", 0, "reset the histograms after this many observations, 0 means never")
+	onParseError   = flag.String("on-parse-error", "fail", "what to do with lines of the datasets that cannot be parsed: fail, or skip (and count) them")
+	maxParseErrors = flag.Int("max-parse-errors", 0, "with --on-parse-error=skip, fail after skipping this many lines per pass through a dataset, 0 means no limit")
+	outOfOrder     = flag.String("out-of-order", outOfOrderAccept, "what to do with observations older than the previous one: accept, reject, reorder (within --reorder-window), or clamp (to the time stamp of the previous one)")
+	reorderWindow  = flag.Duration("reorder-window", time.Minute, "with --out-of-order=reorder, how far (in simulated time) observations may be out of order to get reordered, older ones are rejected")
+	follow         = flag.Bool("follow", false, "keep reading the datasets when reaching their end, waiting for more lines to be appended, like tail -F (a truncated or rotated file is read again from its beginning)")
+	format         = flag.String("format", "text", "format of the datasets: text (time stamp, value, optional weight, and optional name=value labels, separated by spaces), csv (with a header naming the columns), or jsonl (one JSON object per line)")
 )
 
-func observe(in io.Reader) {
+var (
+	datasetFiles   stringsFlag
+	factors        = floatsFlag{1.1}
+	zeroThresholds = floatsFlag{1e-128}
+	mapping        = dataset.DefaultMapping
+)
+
+func init() {
+	flag.StringVar(&mapping.Timestamp, "timestamp-field", mapping.Timestamp, "name of the CSV column or JSON field with the time stamp (RFC3339Nano or seconds since the Unix epoch)")
+	flag.StringVar(&mapping.Value, "value-field", mapping.Value, "name of the CSV column or JSON field with the observed value (a duration or a float)")
+	flag.StringVar(&mapping.Weight, "weight-field", mapping.Weight, "name of the CSV column or JSON field with the number of times the value has been observed, leave empty to observe each value once")
+	flag.Var((*stringsFlag)(&mapping.Labels), "label-fields", "comma-separated list of label names (for the text format) or CSV columns or JSON fields to use as labels of the exposed histograms")
+	flag.Var(&datasetFiles, "dataset", "comma-separated list of input files to read datasets from, each of them is replayed for each combination of --factor and --zero-threshold, gzip and bzip2 compressed files are decompressed, - reads from stdin")
+	flag.Var(&factors, "factor", "comma-separated list of bucket factors, each bucket is by this factor wider than the previous one, must be greater 1")
+	flag.Var(&zeroThresholds, "zero-threshold", "comma-separated list of widths of the “zero” bucket")
+}
+
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(value string) error {
+	*sf = strings.Split(value, ",")
+	return nil
+}
+
+type floatsFlag []float64
+
+func (ff *floatsFlag) String() string {
+	return fmt.Sprint(*ff)
+}
+
+func (ff *floatsFlag) Set(value string) error {
+	*ff = nil
+	for _, ft := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(ft, 64)
+		if err != nil {
+			return err
+		}
+		*ff = append(*ff, f)
+	}
+	return nil
+}
+
+const metricName = "histogram_experiment"
+
+// pass is one pass over the dataset of a replay, starting at the (shifted) time
+// stamp first.
+type pass struct {
+	first time.Time
+	shift time.Duration
+}
+
+// replay is the replay of one dataset into a histogram configured with one
+// combination of factor and zero threshold.
+type replay struct {
+	file    string
+	dataset string // Value of the dataset label.
+	name    string // Identifies the replay in logs and the control API.
+	// The histogram vectors, with their dataset label curried in vec.
+	base, perInstance *prometheus.HistogramVec
+	vec               prometheus.ObserverVec
+	s                 *splitter
+	logger            *log.Logger
+	ctl               *control
+	metrics           replayMetrics
+}
+
+// observe performs the observations from the dataset of the replay rp, each
+// replay with its own time simulation. Each observation is performed as often
+// as its weight says, on the histogram for its labels (see --label-fields). If
+// the replay has a splitter, each observation is also performed on one of its
+// instances. Commands from the control API are acted upon before each
+// observation and after the end of the dataset has been reached.
+func (rp replay) observe() {
+	type child struct {
+		labels  prometheus.Labels
+		his     prometheus.Histogram
+		tracker *limitTracker
+	}
 	var (
-		his = promauto.NewHistogram(prometheus.HistogramOpts{
-			Name:                       "histogram_experiment",
-			Help:                       "Test histogram for an experiment.",
-			SparseBucketsFactor:        *factor,
-			SparseBucketsZeroThreshold: *zeroThreshold,
-		})
-		s              = bufio.NewScanner(in)
-		count          = 0
-		start          = time.Now()
-		simulatedStart time.Time
+		children  = map[string]child{}
+		skipUntil time.Time
+		// Time stamps are shifted by this duration when looping.
+		shift time.Duration
+		// The passes over the dataset so far (with --loop), to resolve
+		// seek targets in any of them.
+		passes []pass
+		// State of the periodic reset of the histograms.
+		sinceReset int
+		nextReset  time.Time
 	)
+	// newChild creates the histogram for labels, identified by key in
+	// children.
+	newChild := func(labels prometheus.Labels, key string) child {
+		c := child{labels: labels, his: rp.vec.With(labels).(prometheus.Histogram)}
+		if *maxBucketNumber > 0 {
+			logger := rp.logger
+			if len(labels) > 0 {
+				logger = log.New(logger.Writer(), logger.Prefix()+key+" ", logger.Flags())
+			}
+			c.tracker = newLimitTracker(c.his, logger)
+		}
+		return c
+	}
+	// reset resets all histograms of the replay. They are recreated right
+	// away, so that their series do not vanish until the next observation
+	// with their labels.
+	reset := func(reason string) {
+		rp.base.DeletePartialMatch(prometheus.Labels{"dataset": rp.dataset})
+		if rp.perInstance != nil {
+			rp.perInstance.DeletePartialMatch(prometheus.Labels{"dataset": rp.dataset})
+		}
+		for key, c := range children {
+			children[key] = newChild(c.labels, key)
+			if rp.s != nil {
+				rp.s.create(c.labels)
+			}
+		}
+		sinceReset = 0
+		rp.logger.Println("Histograms reset", reason+".")
+	}
+	// act acts on cmd and returns true if the replay has to start over
+	// from the beginning of the dataset, skipping observations before
+	// skipUntil. ts is the time stamp of the next observation.
+	act := func(cmd command, ts time.Time) bool {
+		if cmd.reset {
+			reset("as requested")
+		}
+		if !cmd.restart && cmd.seek.IsZero() {
+			return false
+		}
+		if cmd.restart || cmd.seek.Before(ts) || ts.IsZero() {
+			if rp.file == "-" {
+				rp.logger.Println("Cannot start over reading from stdin.")
+				return false
+			}
+			// Start over with the shift of the last pass beginning
+			// at or before the seek target (the first pass for a
+			// restart).
+			k := 0
+			for k+1 < len(passes) && !cmd.seek.Before(passes[k+1].first) {
+				k++
+			}
+			shift = 0
+			if k < len(passes) {
+				shift = passes[k].shift
+			}
+			passes = passes[:k]
+			if *loop {
+				rp.logger.Println("Starting over with pass", k+1, "shifting time stamps by", shift, "in total.")
+			}
+			skipUntil, nextReset = cmd.seek, time.Time{}
+			return true
+		}
+		skipUntil = cmd.seek
+		return false
+	}
 
-	for s.Scan() {
-		count++
-		ss := strings.Split(s.Text(), " ")
-		if len(ss) != 2 {
-			log.Fatalln("Unexpected number of tokens in line", count, ":", len(ss))
+replay:
+	for {
+		in, err := dataset.Open(rp.file, *follow)
+		if err != nil {
+			rp.logger.Fatalln("Could not open dataset file:", err)
 		}
-		ts, err := time.Parse(time.RFC3339Nano, ss[0])
+		src, err := dataset.NewSource(in, *format, mapping)
 		if err != nil {
-			log.Fatalln("Could not parse time stamp in line", count, ":", err)
+			rp.logger.Fatalln("Could not read dataset:", err)
 		}
-		if simulatedStart.IsZero() {
-			simulatedStart = ts
+		r := newTolerantSource(src, rp.metrics.parseErrors)
+		var (
+			count       = 0
+			read        = 0 // Lines with an observation.
+			start       = time.Now()
+			first, last time.Time
+		)
+
+		for {
+			o, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.summary(rp.logger)
+				rp.logger.Fatalln("Could not read dataset:", err)
+			}
+			read++
+			o.Timestamp = o.Timestamp.Add(shift)
+			if first.IsZero() {
+				first = o.Timestamp
+				passes = append(passes, pass{first: first, shift: shift})
+			}
+			for {
+				if act(rp.ctl.take(), o.Timestamp) {
+					in.Close()
+					continue replay
+				}
+				if o.Timestamp.Before(skipUntil) {
+					break
+				}
+				if lag, ok := rp.ctl.wait(o.Timestamp); ok {
+					rp.metrics.lag.Set(lag.Seconds())
+					break
+				}
+			}
+			rp.ctl.setPosition(r.Line(), count, o.Timestamp, false)
+			rp.metrics.simulated.Set(float64(o.Timestamp.UnixNano()) / 1e9)
+			last = o.Timestamp
+			if o.Timestamp.Before(skipUntil) {
+				continue
+			}
+
+			if *resetInterval > 0 {
+				if nextReset.IsZero() {
+					nextReset = o.Timestamp.Add(*resetInterval)
+				}
+				if !o.Timestamp.Before(nextReset) {
+					reset("after " + resetInterval.String())
+					for !o.Timestamp.Before(nextReset) {
+						nextReset = nextReset.Add(*resetInterval)
+					}
+				}
+			}
+			var (
+				labels = prometheus.Labels{}
+				pairs  []string
+			)
+			for _, name := range mapping.Labels {
+				labels[name] = o.Labels[name]
+				pairs = append(pairs, name+"="+o.Labels[name])
+			}
+			key := strings.Join(pairs, " ")
+			c, ok := children[key]
+			if !ok {
+				c = newChild(labels, key)
+				children[key] = c
+			}
+			for i := uint64(0); i < o.Weight; i++ {
+				// Checked for each observation, as a weighted
+				// line might cross the threshold.
+				if *resetAfter > 0 && sinceReset >= *resetAfter {
+					reset(fmt.Sprint("after ", sinceReset, " observations"))
+					c = children[key]
+				}
+				count++
+				sinceReset++
+				begin := time.Now()
+				c.his.Observe(o.Value)
+				if rp.s != nil {
+					rp.s.observe(o, labels)
+				}
+				if c.tracker != nil {
+					c.tracker.track(o.Value, o.Timestamp, r.Line())
+				}
+				rp.metrics.observeDuration.Observe(time.Since(begin).Seconds())
+				rp.metrics.observations.Inc()
+			}
 		}
-		if *timeFactor > 0 {
-			desiredTimeOffset := time.Duration(float64(ts.Sub(simulatedStart)) / *timeFactor)
-			currentTimeOffset := time.Since(start)
-			time.Sleep(desiredTimeOffset - currentTimeOffset)
+		in.Close()
+		rp.ctl.setPosition(r.Line(), count, last, !*loop)
+		rp.logger.Println("Performed", count, "observations in", time.Since(start), ".")
+		r.summary(rp.logger)
+		for _, c := range children {
+			if c.tracker != nil {
+				c.tracker.report()
+			}
 		}
-		if duration, err := time.ParseDuration(ss[1]); err == nil {
-			his.Observe(duration.Seconds())
-		} else {
-			// It doesn't appear to be a duration. Try raw number.
-			v, err := strconv.ParseFloat(ss[1], 64)
-			if err != nil {
-				log.Fatalln("Could not parse value in line", count, ":", err)
+
+		if *loop && count > 0 {
+			// Start over right after the last observation, with
+			// the average time between observations in between.
+			// Skipped lines do not count, as they have no time
+			// stamp.
+			span := last.Sub(first)
+			shift += span + span/time.Duration(max(read-1, 1))
+			rp.logger.Println("Looping, shifting time stamps by", shift, "in total.")
+			continue
+		}
+
+		// The end of the dataset. Wait for commands to start over.
+		for {
+			rp.ctl.waitForCommand()
+			if act(rp.ctl.take(), time.Time{}) {
+				continue replay
 			}
-			his.Observe(v)
 		}
 	}
-	if s.Err() != nil {
-		log.Fatalln("Could not complete reading dataset file:", s.Err())
-	}
-	log.Println("Performed", count, "observations in", time.Since(start), ".")
+}
+
+// pushOTLP pushes the current state of the (only) histogram of vec every
+// --otlp-interval.
+func pushOTLP(vec prometheus.ObserverVec, temporality pmetric.AggregationTemporality) {
+	var (
+		e    = otlp.NewExporter(*otlpEndpoint, metricName, temporality, time.Now())
+		tick = time.NewTicker(*otlpInterval)
+	)
+	defer tick.Stop()
 
+	for ts := range tick.C {
+		var m dto.Metric
+		if err := vec.With(nil).(prometheus.Histogram).Write(&m); err != nil {
+			log.Fatalln("Could not collect histogram:", err)
+		}
+		h, err := native.Decode(m.GetHistogram())
+		if err != nil {
+			log.Fatalln("Could not decode histogram:", err)
+		}
+		n, err := e.Export(h, ts)
+		if err != nil {
+			log.Println("Could not push OTLP request:", err)
+			continue
+		}
+		log.Printf("Pushed OTLP exponential histogram (%s): %d bytes.", *otlpTemporality, n)
+	}
 }
 
 func main() {
 	flag.Parse()
-	if *factor <= 1 {
-		log.Fatalln("--factor must by greater than 1, provided value:", *factor)
+	if len(datasetFiles) == 0 {
+		log.Fatalln("--dataset must name at least one file")
+	}
+	for _, f := range factors {
+		if f <= 1 {
+			log.Fatalln("--factor must by greater than 1, provided value:", f)
+		}
+	}
+	if *maxBucketNumber > math.MaxUint32 {
+		log.Fatalln("--max-bucket-number must not be greater than", uint32(math.MaxUint32), "provided value:", *maxBucketNumber)
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	for _, name := range mapping.Labels {
+		if !model.LabelName(name).IsValid() || name == "dataset" || name == "instance" {
+			log.Fatalln("--label-fields must be valid label names other than dataset and instance, provided value:", name)
+		}
+	}
 
-	f, err := os.Open(*dataset)
+	temporality, err := otlp.ParseTemporality(*otlpTemporality)
 	if err != nil {
-		log.Fatalln("Could not open dataset file:", err)
+		log.Fatalln("Invalid --otlp-temporality:", err)
+	}
+
+	// The dataset label is the base name of the file (without compression
+	// extension), which therefore has to be unique.
+	names := map[string]string{}
+	for _, f := range datasetFiles {
+		name := dataset.Name(f)
+		if other, ok := names[name]; ok {
+			log.Fatalln("Datasets", other, "and", f, "have the same name.")
+		}
+		names[name] = f
 	}
-	defer f.Close()
 
-	go observe(f)
+	// One histogram vector per configuration, with the configuration as
+	// constant labels, so that they can all be registered under the same
+	// name.
+	var replays []replay
+	for _, factor := range factors {
+		for _, zeroThreshold := range zeroThresholds {
+			config := prometheus.Labels{
+				"factor":         fmt.Sprint(factor),
+				"zero_threshold": fmt.Sprint(zeroThreshold),
+			}
+			opts := prometheus.HistogramOpts{
+				Name:                            metricName,
+				Help:                            "Test histogram for an experiment.",
+				ConstLabels:                     config,
+				NativeHistogramBucketFactor:     factor,
+				NativeHistogramZeroThreshold:    zeroThreshold,
+				NativeHistogramMaxBucketNumber:  uint32(*maxBucketNumber),
+				NativeHistogramMinResetDuration: *minResetDuration,
+				NativeHistogramMaxZeroThreshold: *maxZeroThreshold,
+			}
+			labelNames := append([]string{"dataset"}, mapping.Labels...)
+			vec := promauto.NewHistogramVec(opts, labelNames)
+			var perInstance *prometheus.HistogramVec
+			if *instances > 1 {
+				opts.Name = metricName + "_per_instance"
+				opts.Help = "Test histogram for an experiment, with the observations split over simulated instances."
+				perInstance = promauto.NewHistogramVec(opts, append(labelNames, "instance"))
+			}
+			for _, f := range datasetFiles {
+				name := dataset.Name(f)
+				rp := replay{
+					file:        f,
+					dataset:     name,
+					name:        fmt.Sprintf("%s factor=%g zero_threshold=%g", name, factor, zeroThreshold),
+					base:        vec,
+					perInstance: perInstance,
+					vec:         vec.MustCurryWith(prometheus.Labels{"dataset": name}),
+					ctl:         newControl(*timeFactor),
+					metrics: newReplayMetrics(prometheus.Labels{
+						"dataset":        name,
+						"factor":         config["factor"],
+						"zero_threshold": config["zero_threshold"],
+					}),
+				}
+				rp.logger = log.New(log.Writer(), "["+rp.name+"] ", log.Flags()|log.Lmsgprefix)
+				if perInstance != nil {
+					curried := perInstance.MustCurryWith(prometheus.Labels{"dataset": name})
+					if rp.s, err = newSplitter(curried, *instances, *split); err != nil {
+						log.Fatalln("Invalid --split:", err)
+					}
+				}
+				replays = append(replays, rp)
+			}
+		}
+	}
+	if *onParseError != "fail" && *onParseError != "skip" {
+		log.Fatalln("--on-parse-error must be fail or skip, provided value:", *onParseError)
+	}
+	switch *outOfOrder {
+	case outOfOrderAccept, outOfOrderReject, outOfOrderReorder, outOfOrderClamp:
+	default:
+		log.Fatalln("--out-of-order must be accept, reject, reorder, or clamp, provided value:", *outOfOrder)
+	}
+	if *loop && *follow {
+		log.Fatalln("--loop and --follow are mutually exclusive.")
+	}
+	if _, ok := names["stdin"]; ok && *loop {
+		log.Fatalln("--loop is impossible when reading the dataset from stdin.")
+	}
+	if _, ok := names["stdin"]; ok && len(replays) > 1 {
+		log.Fatalln("Reading the dataset from stdin requires a single dataset, factor, and zero threshold, but there are", len(replays), "combinations.")
+	}
+	if *otlpEndpoint != "" && (len(replays) > 1 || len(mapping.Labels) > 0) {
+		log.Fatalln("--otlp-endpoint requires a single dataset, factor, and zero threshold without --label-fields, but there are", len(replays), "combinations.")
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/replay/", controlHandler(replays))
+	if *otlpReceiver {
+		http.Handle("/v1/metrics", otlp.NewReceiver())
+	}
+
+	for _, rp := range replays {
+		go rp.observe()
+	}
+	if *otlpEndpoint != "" {
+		go pushOTLP(replays[0].vec, temporality)
+	}
 
 	log.Println("Serving metrics, SIGTERM to abort…")
 	http.ListenAndServe(*addr, nil)
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The self-instrumentation of the replays, exposed on the same registry as the
+// replayed histograms, so that effects of the histograms can be told apart
+// from stalls of the replay in the scraped data. The observation latency is a
+// classic histogram, so that it does not mix with the native histograms to be
+// analyzed.
+var (
+	replayLabels = []string{"dataset", "factor", "zero_threshold"}
+
+	observationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exposer_replay_observations_total",
+		Help: "Observations performed by the replay, counting each unit of weight.",
+	}, replayLabels)
+	parseErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exposer_replay_parse_errors_total",
+		Help: "Lines of the dataset the replay could not parse.",
+	}, replayLabels)
+	lagSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "exposer_replay_lag_seconds",
+		Help: "Desired minus current wall-clock offset of the last observation relative to the start of the time simulation, negative if the replay is behind the simulated clock (always 0 without time simulation).",
+	}, replayLabels)
+	simulatedTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "exposer_replay_simulated_timestamp_seconds",
+		Help: "Simulated time stamp of the last observation in seconds since the Unix epoch.",
+	}, replayLabels)
+	observeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exposer_replay_observe_duration_seconds",
+		Help:    "Wall-clock time taken to perform one observation, including the simulated instances and limit tracking.",
+		Buckets: prometheus.ExponentialBuckets(100e-9, 4, 10), // 100ns to 26ms.
+	}, replayLabels)
+)
+
+// replayMetrics are the self-instrumentation metrics of one replay.
+type replayMetrics struct {
+	observations, parseErrors prometheus.Counter
+	lag, simulated            prometheus.Gauge
+	observeDuration           prometheus.Observer
+}
+
+func newReplayMetrics(labels prometheus.Labels) replayMetrics {
+	return replayMetrics{
+		observations:    observationsTotal.With(labels),
+		parseErrors:     parseErrorsTotal.With(labels),
+		lag:             lagSeconds.With(labels),
+		simulated:       simulatedTimestamp.With(labels),
+		observeDuration: observeDuration.With(labels),
+	}
+}
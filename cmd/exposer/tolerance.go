@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+)
+
+// maxReportedErrors is the maximum number of skipped parse errors listed in
+// the summary.
+const maxReportedErrors = 5
+
+// Policies for observations out of chronological order, see --out-of-order.
+const (
+	outOfOrderAccept  = "accept"
+	outOfOrderReject  = "reject"
+	outOfOrderReorder = "reorder"
+	outOfOrderClamp   = "clamp"
+)
+
+// tolerantSource wraps a dataset.Source and applies the configured policies
+// for unparsable lines and for observations out of chronological order. It
+// keeps track of everything it skips or alters for the summary.
+type tolerantSource struct {
+	src         dataset.Source
+	parseErrors prometheus.Counter
+
+	skipErrors bool
+	maxErrors  int // 0 means no limit.
+	outOfOrder string
+	window     time.Duration
+
+	// Time stamp of the last returned observation and, if reordering, the
+	// latest time stamp read so far.
+	last, newest time.Time
+	// Buffer for reordering, and the line of the last returned observation.
+	buf  obsHeap
+	seq  int
+	line int
+	eof  bool
+
+	skipped                      []error
+	rejected, reordered, clamped int
+}
+
+func newTolerantSource(src dataset.Source, parseErrors prometheus.Counter) *tolerantSource {
+	return &tolerantSource{
+		src:         src,
+		parseErrors: parseErrors,
+		skipErrors:  *onParseError == "skip",
+		maxErrors:   *maxParseErrors,
+		outOfOrder:  *outOfOrder,
+		window:      *reorderWindow,
+	}
+}
+
+// Read implements dataset.Source. Parse errors are only returned if they are
+// not skipped.
+func (t *tolerantSource) Read() (dataset.Observation, error) {
+	for {
+		if t.outOfOrder == outOfOrderReorder && len(t.buf) > 0 &&
+			(t.eof || !t.buf[0].o.Timestamp.After(t.newest.Add(-t.window))) {
+			e := heap.Pop(&t.buf).(obsEntry)
+			t.last, t.line = e.o.Timestamp, e.line
+			return e.o, nil
+		}
+		if t.eof {
+			return dataset.Observation{}, io.EOF
+		}
+		o, err := t.src.Read()
+		if err == io.EOF {
+			t.eof = true
+			continue
+		}
+		var pe *dataset.ParseError
+		if errors.As(err, &pe) {
+			t.parseErrors.Inc()
+			if !t.skipErrors || t.maxErrors > 0 && len(t.skipped) >= t.maxErrors {
+				return o, err
+			}
+			t.skipped = append(t.skipped, err)
+			continue
+		}
+		if err != nil {
+			return o, err
+		}
+
+		outOfOrder := o.Timestamp.Before(t.last)
+		switch t.outOfOrder {
+		case outOfOrderReject:
+			if outOfOrder {
+				t.rejected++
+				continue
+			}
+		case outOfOrderClamp:
+			if outOfOrder {
+				o.Timestamp = t.last
+				t.clamped++
+			}
+		case outOfOrderReorder:
+			// Observations older than the window or than the last
+			// returned one cannot be reordered anymore.
+			if outOfOrder || o.Timestamp.Before(t.newest.Add(-t.window)) {
+				t.rejected++
+				continue
+			}
+			if o.Timestamp.Before(t.newest) {
+				t.reordered++
+			} else {
+				t.newest = o.Timestamp
+			}
+			heap.Push(&t.buf, obsEntry{o: o, line: t.src.Line(), seq: t.seq})
+			t.seq++
+			continue
+		}
+		if o.Timestamp.After(t.last) {
+			t.last = o.Timestamp
+		}
+		t.line = t.src.Line()
+		return o, nil
+	}
+}
+
+// Line implements dataset.Source. It returns the line of the last returned
+// observation.
+func (t *tolerantSource) Line() int {
+	return t.line
+}
+
+// summary logs everything that has been skipped or altered.
+func (t *tolerantSource) summary(logger *log.Logger) {
+	if n := len(t.skipped); n > 0 {
+		logger.Println("Skipped", n, "unparsable lines:")
+		for _, err := range t.skipped[:min(n, maxReportedErrors)] {
+			logger.Println("  ", err)
+		}
+		if n > maxReportedErrors {
+			logger.Println("   …and", n-maxReportedErrors, "more.")
+		}
+	}
+	if t.rejected > 0 {
+		reason := "out of chronological order"
+		if t.outOfOrder == outOfOrderReorder {
+			reason = fmt.Sprint("too far out of chronological order to reorder them within ", t.window)
+		}
+		logger.Println("Rejected", t.rejected, "observations", reason+".")
+	}
+	if t.reordered > 0 {
+		logger.Println("Reordered", t.reordered, "observations out of chronological order.")
+	}
+	if t.clamped > 0 {
+		logger.Println("Clamped the time stamps of", t.clamped, "observations out of chronological order.")
+	}
+}
+
+// obsEntry is an observation buffered for reordering.
+type obsEntry struct {
+	o         dataset.Observation
+	line, seq int
+}
+
+// obsHeap is a min-heap of observations, ordered by time stamp and, for equal
+// time stamps, by the order they have been read in.
+type obsHeap []obsEntry
+
+func (h obsHeap) Len() int { return len(h) }
+func (h obsHeap) Less(i, j int) bool {
+	if h[i].o.Timestamp.Equal(h[j].o.Timestamp) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].o.Timestamp.Before(h[j].o.Timestamp)
+}
+func (h obsHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *obsHeap) Push(x any)   { *h = append(*h, x.(obsEntry)) }
+func (h *obsHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -47,8 +47,10 @@ func (g *WrappingGatherer) Gather() ([]*dto.MetricFamily, error) {
 	if err != nil {
 		return mfs, err
 	}
-	integerCounter := *mfs[0]
-	floatCounter, floatGauge, integerGauge := integerCounter, integerCounter, integerCounter
+	integerCounter := mfs[0]
+	floatCounter := proto.Clone(integerCounter).(*dto.MetricFamily)
+	floatGauge := proto.Clone(integerCounter).(*dto.MetricFamily)
+	integerGauge := proto.Clone(integerCounter).(*dto.MetricFamily)
 
 	floatCounter.Name = proto.String("float_counter_histogram")
 	floatGauge.Name = proto.String("float_gauge_histogram")
@@ -57,7 +59,7 @@ func (g *WrappingGatherer) Gather() ([]*dto.MetricFamily, error) {
 	floatGauge.Type = dto.MetricType_GAUGE_HISTOGRAM.Enum()
 	integerGauge.Type = dto.MetricType_GAUGE_HISTOGRAM.Enum()
 
-	fH := *integerCounter.Metric[0].Histogram
+	fH := proto.Clone(integerCounter.Metric[0].Histogram).(*dto.Histogram)
 	fH.SampleCountFloat = proto.Float64(float64(*fH.SampleCount) / 2)
 	fH.SampleCount = nil
 	fH.SampleSum = proto.Float64(*fH.SampleSum / 2)
@@ -77,14 +79,14 @@ func (g *WrappingGatherer) Gather() ([]*dto.MetricFamily, error) {
 	}
 	fH.NegativeDelta = nil
 
-	metric := *integerCounter.Metric[0]
-	metrics := []*dto.Metric{&metric}
-	metric.Histogram = &fH
+	metric := proto.Clone(integerCounter.Metric[0]).(*dto.Metric)
+	metrics := []*dto.Metric{metric}
+	metric.Histogram = fH
 
 	floatCounter.Metric = metrics
 	floatGauge.Metric = metrics
 
-	mfs = append(mfs, &floatCounter, &floatGauge, &integerGauge)
+	mfs = append(mfs, floatCounter, floatGauge, integerGauge)
 	return mfs, nil
 }
 
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// distribution is a parametric distribution of observed values.
+type distribution interface {
+	sample(r *rand.Rand) float64
+	cdf(x float64) float64
+}
+
+type normal struct{ mean, stdDev float64 }
+
+func (d normal) sample(r *rand.Rand) float64 { return r.NormFloat64()*d.stdDev + d.mean }
+func (d normal) cdf(x float64) float64 {
+	return 0.5 * math.Erfc(-(x-d.mean)/(d.stdDev*math.Sqrt2))
+}
+
+type lognormal struct{ mu, sigma float64 }
+
+func (d lognormal) sample(r *rand.Rand) float64 { return math.Exp(r.NormFloat64()*d.sigma + d.mu) }
+func (d lognormal) cdf(x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	return normal{d.mu, d.sigma}.cdf(math.Log(x))
+}
+
+type exponential struct{ mean float64 }
+
+func (d exponential) sample(r *rand.Rand) float64 { return r.ExpFloat64() * d.mean }
+func (d exponential) cdf(x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	return 1 - math.Exp(-x/d.mean)
+}
+
+type pareto struct{ scale, shape float64 }
+
+func (d pareto) sample(r *rand.Rand) float64 {
+	// 1-Float64() is in (0, 1], avoiding a division by zero.
+	return d.scale / math.Pow(1-r.Float64(), 1/d.shape)
+}
+func (d pareto) cdf(x float64) float64 {
+	if x < d.scale {
+		return 0
+	}
+	return 1 - math.Pow(d.scale/x, d.shape)
+}
+
+type uniform struct{ min, max float64 }
+
+func (d uniform) sample(r *rand.Rand) float64 { return d.min + r.Float64()*(d.max-d.min) }
+func (d uniform) cdf(x float64) float64 {
+	switch {
+	case x < d.min:
+		return 0
+	case x >= d.max:
+		return 1
+	}
+	return (x - d.min) / (d.max - d.min)
+}
+
+// mixture is a weighted mixture of distributions, e.g. a bimodal one.
+type mixture struct {
+	weights    []float64 // Normalized to a sum of 1.
+	components []distribution
+}
+
+func (d mixture) sample(r *rand.Rand) float64 {
+	u := r.Float64()
+	for i, w := range d.weights {
+		if u < w || i == len(d.weights)-1 {
+			return d.components[i].sample(r)
+		}
+		u -= w
+	}
+	panic("empty mixture")
+}
+
+func (d mixture) cdf(x float64) float64 {
+	var c float64
+	for i, w := range d.weights {
+		c += w * d.components[i].cdf(x)
+	}
+	return c
+}
+
+// parseDistribution parses a distribution given as NAME:PARAM,PARAM,… or as a
+// mixture of those, separated by '|', each optionally prefixed with a weight
+// and '*' (e.g. '0.9*lognormal:-2,0.5|0.1*normal:3,0.5').
+func parseDistribution(s string) (distribution, error) {
+	parts := strings.Split(s, "|")
+	if len(parts) == 1 && !strings.Contains(s, "*") {
+		return parseSimple(s)
+	}
+	var (
+		m   mixture
+		sum float64
+	)
+	for _, p := range parts {
+		w := 1.0
+		if ws, rest, ok := strings.Cut(p, "*"); ok {
+			var err error
+			if w, err = strconv.ParseFloat(ws, 64); err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight %q", ws)
+			}
+			p = rest
+		}
+		d, err := parseSimple(p)
+		if err != nil {
+			return nil, err
+		}
+		m.weights = append(m.weights, w)
+		m.components = append(m.components, d)
+		sum += w
+	}
+	for i := range m.weights {
+		m.weights[i] /= sum
+	}
+	return m, nil
+}
+
+func parseSimple(s string) (distribution, error) {
+	name, ps, _ := strings.Cut(s, ":")
+	var params []float64
+	if ps != "" {
+		for _, p := range strings.Split(ps, ",") {
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter of %s: %w", name, err)
+			}
+			params = append(params, v)
+		}
+	}
+	want := map[string]int{"normal": 2, "lognormal": 2, "exponential": 1, "pareto": 2, "uniform": 2}
+	n, ok := want[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown distribution %q", name)
+	}
+	if len(params) != n {
+		return nil, fmt.Errorf("%s needs %d parameters, got %d", name, n, len(params))
+	}
+	switch name {
+	case "normal":
+		if params[1] <= 0 {
+			return nil, errors.New("standard deviation of normal must be positive")
+		}
+		return normal{params[0], params[1]}, nil
+	case "lognormal":
+		if params[1] <= 0 {
+			return nil, errors.New("sigma of lognormal must be positive")
+		}
+		return lognormal{params[0], params[1]}, nil
+	case "exponential":
+		if params[0] <= 0 {
+			return nil, errors.New("mean of exponential must be positive")
+		}
+		return exponential{params[0]}, nil
+	case "pareto":
+		if params[0] <= 0 || params[1] <= 0 {
+			return nil, errors.New("scale and shape of pareto must be positive")
+		}
+		return pareto{params[0], params[1]}, nil
+	default: // uniform
+		if params[1] <= params[0] {
+			return nil, errors.New("max of uniform must be greater than min")
+		}
+		return uniform{params[0], params[1]}, nil
+	}
+}
+
+// negativeHandling maps a distribution onto one where negative values are
+// allowed, replaced by zero, replaced by their absolute value, or dropped.
+type negativeHandling string
+
+func (nh negativeHandling) valid() bool {
+	switch nh {
+	case "allow", "zero", "abs", "drop":
+		return true
+	}
+	return false
+}
+
+// apply returns the value to observe for the sampled v, with false if it is
+// to be dropped.
+func (nh negativeHandling) apply(v float64) (float64, bool) {
+	if v >= 0 {
+		return v, true
+	}
+	switch nh {
+	case "zero":
+		return 0, true
+	case "abs":
+		return -v, true
+	case "drop":
+		return 0, false
+	}
+	return v, true
+}
+
+// cdf returns the cumulative distribution function of d after applying nh.
+func (nh negativeHandling) cdf(d distribution, x float64) float64 {
+	switch nh {
+	case "zero":
+		if x < 0 {
+			return 0
+		}
+	case "abs":
+		if x < 0 {
+			return 0
+		}
+		// P(|X| ≤ x), including X = -x for continuous distributions.
+		return d.cdf(x) - d.cdf(math.Nextafter(-x, math.Inf(-1)))
+	case "drop":
+		if x < 0 {
+			return 0
+		}
+		neg := d.cdf(math.Nextafter(0, math.Inf(-1)))
+		if neg >= 1 {
+			return 1
+		}
+		return (d.cdf(x) - neg) / (1 - neg)
+	}
+	return d.cdf(x)
+}
+
+// quantile finds the q-quantile of a distribution given by its cdf by
+// bisection.
+func quantile(cdf func(float64) float64, q float64) float64 {
+	lo, hi := -1.0, 1.0
+	for cdf(lo) >= q && lo > -math.MaxFloat64/2 {
+		lo *= 2
+	}
+	for cdf(hi) < q && hi < math.MaxFloat64/2 {
+		hi *= 2
+	}
+	for i := 0; i < 200 && lo < hi; i++ {
+		mid := lo + (hi-lo)/2
+		if mid == lo || mid == hi {
+			break
+		}
+		if cdf(mid) < q {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
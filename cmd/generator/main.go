@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	output    = flag.String("output", "-", "dataset file to write, - for stdout")
+	start     = flag.String("start", "2020-01-01T00:00:00Z", "RFC3339 time stamp of the start of the dataset")
+	duration  = flag.Duration("duration", time.Hour, "duration covered by the dataset (ignored if --regime is set)")
+	rate      = flag.Float64("rate", 100, "average number of observations per second, with exponentially distributed time between them (ignored if --regime is set)")
+	distSpec  = flag.String("distribution", "lognormal:-2,0.5", "distribution of the observed values (ignored if --regime is set): normal:MEAN,STDDEV, lognormal:MU,SIGMA, exponential:MEAN, pareto:SCALE,SHAPE, uniform:MIN,MAX, or a mixture of those, separated by '|', each optionally prefixed by a weight and '*', e.g. '0.9*lognormal:-2,0.5|0.1*normal:3,0.5'")
+	seed      = flag.Int64("seed", 1, "seed of the random number generator, the same seed results in the same dataset")
+	negative  = flag.String("negative", "allow", "what to do with negative values: allow them, replace them by zero, replace them by their absolute value (abs), or drop them")
+	regimes   regimesFlag
+	quantiles = quantilesFlag{0.5, 0.9, 0.99, 0.999}
+)
+
+func init() {
+	flag.Var(&regimes, "regime", "a phase of the dataset as 'DURATION RATE DISTRIBUTION', separated by spaces, e.g. '10m 100 lognormal:-2,0.5', can be repeated to create piecewise-changing regimes")
+	flag.Var(&quantiles, "quantiles", "comma-separated list of quantiles to report as ground truth, both of the generated values and of the distribution")
+}
+
+// regime is a phase of the dataset with a constant rate and distribution.
+type regime struct {
+	duration time.Duration
+	rate     float64
+	dist     distribution
+}
+
+func parseRegime(d time.Duration, r float64, dist string) (regime, error) {
+	if d <= 0 {
+		return regime{}, errors.New("duration must be positive")
+	}
+	if r <= 0 {
+		return regime{}, errors.New("rate must be positive")
+	}
+	pd, err := parseDistribution(dist)
+	if err != nil {
+		return regime{}, err
+	}
+	return regime{duration: d, rate: r, dist: pd}, nil
+}
+
+type regimesFlag []regime
+
+func (rf *regimesFlag) String() string {
+	return fmt.Sprint(len(*rf), " regimes")
+}
+
+func (rf *regimesFlag) Set(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return fmt.Errorf("regime %q must have three fields", value)
+	}
+	d, err := time.ParseDuration(fields[0])
+	if err != nil {
+		return err
+	}
+	r, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return err
+	}
+	rg, err := parseRegime(d, r, fields[2])
+	if err != nil {
+		return err
+	}
+	*rf = append(*rf, rg)
+	return nil
+}
+
+type quantilesFlag []float64
+
+func (qf *quantilesFlag) String() string {
+	return fmt.Sprint(*qf)
+}
+
+func (qf *quantilesFlag) Set(value string) error {
+	*qf = nil
+	if value == "" {
+		return nil
+	}
+	for _, qs := range strings.Split(value, ",") {
+		q, err := strconv.ParseFloat(qs, 64)
+		if err != nil {
+			return err
+		}
+		if q < 0 || q > 1 {
+			return fmt.Errorf("quantile %g not between 0 and 1", q)
+		}
+		*qf = append(*qf, q)
+	}
+	return nil
+}
+
+// generate writes the observations of all regimes to w and returns the
+// observed values.
+func generate(w io.Writer, r *rand.Rand, ts time.Time, nh negativeHandling) []float64 {
+	var vals []float64
+	for _, rg := range regimes {
+		end := ts.Add(rg.duration)
+		for {
+			ts = ts.Add(time.Duration(r.ExpFloat64() / rg.rate * float64(time.Second)))
+			if !ts.Before(end) {
+				break
+			}
+			v, ok := nh.apply(rg.dist.sample(r))
+			if !ok {
+				continue
+			}
+			fmt.Fprintln(w, ts.Format(time.RFC3339Nano), strconv.FormatFloat(v, 'g', -1, 64))
+			vals = append(vals, v)
+		}
+		ts = end
+	}
+	return vals
+}
+
+// cdf returns the cumulative distribution function of all regimes combined,
+// each weighted by its expected number of observations.
+func cdf(nh negativeHandling) func(float64) float64 {
+	var (
+		weights []float64
+		sum     float64
+	)
+	for _, rg := range regimes {
+		w := rg.rate * rg.duration.Seconds()
+		if nh == "drop" {
+			w *= 1 - rg.dist.cdf(math.Nextafter(0, math.Inf(-1)))
+		}
+		weights = append(weights, w)
+		sum += w
+	}
+	return func(x float64) float64 {
+		var c float64
+		for i, rg := range regimes {
+			c += weights[i] / sum * nh.cdf(rg.dist, x)
+		}
+		return c
+	}
+}
+
+func main() {
+	flag.Parse()
+	nh := negativeHandling(*negative)
+	if !nh.valid() {
+		log.Fatalln("--negative must be allow, zero, abs, or drop, provided value:", *negative)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, *start)
+	if err != nil {
+		log.Fatalln("Invalid --start:", err)
+	}
+	if len(regimes) == 0 {
+		rg, err := parseRegime(*duration, *rate, *distSpec)
+		if err != nil {
+			log.Fatalln("Invalid --duration, --rate, or --distribution:", err)
+		}
+		regimes = append(regimes, rg)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln("Could not create dataset file:", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	vals := generate(w, rand.New(rand.NewSource(*seed)), ts, nh)
+	if err := w.Flush(); err != nil {
+		log.Fatalln("Could not write dataset:", err)
+	}
+
+	log.Println("Generated", len(vals), "observations.")
+	if len(vals) == 0 {
+		return
+	}
+	sort.Float64s(vals)
+	c := cdf(nh)
+	for _, q := range quantiles {
+		// The exact quantile of the generated values (nearest-rank
+		// method).
+		rank := int(math.Ceil(q*float64(len(vals)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		log.Printf("q=%g: generated %g, distribution %g", q, vals[rank], quantile(c, q))
+	}
+}
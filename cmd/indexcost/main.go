@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricName       = flag.String("metric-name", "request_duration_seconds", "name of the modeled histogram")
+	labelValueLength = flag.Int("label-value-length", 8, "assumed length of each label value in bytes")
+	scrapeInterval   = flag.Duration("scrape-interval", 15*time.Second, "scrape interval")
+	blockDuration    = flag.Duration("block-duration", 2*time.Hour, "time range covered by the modeled block")
+	samplesPerChunk  = flag.Int("samples-per-chunk", 120, "number of samples after which a chunk is cut")
+	timestampBits    = flag.Float64("timestamp-bits", 1, "bits per sample needed for the time stamp (1 for perfectly regular scrapes, as a ΔΔ of zero takes one bit)")
+	nativeBytes      = flag.Float64("native-bytes-per-scrape", 0, "chunk bytes per scrape of one native histogram (excluding time stamps), e.g. the “bytes per scrape” reported by the scraper with --bit-buckets")
+	classicBytes     = flag.Float64("classic-bytes-per-scrape", 0, "chunk bytes per scrape of all series of one classic histogram (excluding time stamps), e.g. as reported by the scraper for the classic representation")
+
+	cardinalities labelsFlag
+	bounds        = floatsFlag(prometheus.DefBuckets)
+)
+
+func init() {
+	flag.Var(&cardinalities, "labels", "comma-separated list of label names with their number of distinct values, e.g. 'instance=100,method=5,status=4' (the histogram is assumed to have a series for every combination)")
+	flag.Var(&bounds, "classic-buckets", "comma-separated list of the upper bounds of the classic buckets, excluding +Inf")
+}
+
+type labelCardinality struct {
+	name   string
+	values int
+}
+
+type labelsFlag []labelCardinality
+
+func (lf *labelsFlag) String() string {
+	return fmt.Sprint(*lf)
+}
+
+func (lf *labelsFlag) Set(value string) error {
+	*lf = nil
+	for _, l := range strings.Split(value, ",") {
+		name, n, ok := strings.Cut(l, "=")
+		if !ok {
+			return fmt.Errorf("label %q has no cardinality", l)
+		}
+		values, err := strconv.Atoi(n)
+		if err != nil {
+			return err
+		}
+		if values < 1 {
+			return fmt.Errorf("cardinality of label %q must be positive", name)
+		}
+		*lf = append(*lf, labelCardinality{name: name, values: values})
+	}
+	return nil
+}
+
+type floatsFlag []float64
+
+func (ff *floatsFlag) String() string {
+	return fmt.Sprint(*ff)
+}
+
+func (ff *floatsFlag) Set(value string) error {
+	*ff = nil
+	for _, ft := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(ft, 64)
+		if err != nil {
+			return err
+		}
+		*ff = append(*ff, f)
+	}
+	return nil
+}
+
+// metric describes the series a histogram representation consists of: For
+// each combination of the label values, there is one series per name and
+// (for the _bucket series) per value of the le label.
+type metric struct {
+	names    []string
+	leValues []string // Only for classic histograms.
+}
+
+// seriesPerCombination returns the number of series for each combination of
+// the label values.
+func (m metric) seriesPerCombination() int {
+	if len(m.leValues) == 0 {
+		return len(m.names)
+	}
+	return len(m.names) - 1 + len(m.leValues)
+}
+
+// cost is the modeled cost of storing a histogram representation in a block.
+type cost struct {
+	series                                int
+	symbols, seriesEntries, postings, idx int
+	chunks, chunkBytes                    int
+}
+
+// uvarintLen returns the number of bytes of x encoded as a uvarint.
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+// model estimates the cost of m in a block, following the structure of the
+// index format (version 2) of the Prometheus TSDB. It is a model, not an
+// exact calculation: Symbols are referenced by their position, which is
+// assumed to be of average size. Label values are assumed to be of equal
+// length. Table of contents and the (unused) label index are ignored.
+func model(m metric, bytesPerScrape float64) cost {
+	var c cost
+
+	// Symbol table: Every distinct string is stored once, as a uvarint
+	// length followed by the string itself. Plus length, count, and CRC32.
+	var symbols []string
+	symbols = append(symbols, "__name__")
+	symbols = append(symbols, m.names...)
+	for _, l := range cardinalities {
+		symbols = append(symbols, l.name)
+		for i := 0; i < l.values; i++ {
+			symbols = append(symbols, strings.Repeat("x", *labelValueLength))
+		}
+	}
+	if len(m.leValues) > 0 {
+		symbols = append(symbols, "le")
+		symbols = append(symbols, m.leValues...)
+	}
+	c.symbols = 4 + 4 + 4
+	refBytes := 0
+	for i, s := range symbols {
+		c.symbols += uvarintLen(uint64(len(s))) + len(s)
+		refBytes += uvarintLen(uint64(i))
+	}
+	avgRef := float64(refBytes) / float64(len(symbols))
+
+	combinations := 1
+	for _, l := range cardinalities {
+		combinations *= l.values
+	}
+	perCombination := m.seriesPerCombination()
+	c.series = combinations * perCombination
+
+	// Series entries: uvarint length, number of labels, a pair of symbol
+	// references per label, number of chunks, and per chunk its mint,
+	// maxt delta, and reference delta, followed by a CRC32. Each entry is
+	// 16-byte aligned.
+	scrapes := int(*blockDuration / *scrapeInterval)
+	chunksPerSeries := (scrapes + *samplesPerChunk - 1) / *samplesPerChunk
+	chunkMeta := 6 + 3 + 3 // Typical varint sizes for time stamps in ms and chunk refs.
+	labelsPerSeries := float64(1 + len(cardinalities))
+	if len(m.leValues) > 0 {
+		// Only the _bucket series have the le label, on average:
+		labelsPerSeries += float64(len(m.leValues)) / float64(perCombination)
+	}
+	entry := 2 + 1 + int(math.Ceil(2*avgRef*labelsPerSeries)) + 1 + chunksPerSeries*chunkMeta + 4
+	entry = (entry + 15) / 16 * 16
+	c.seriesEntries = c.series * entry
+
+	// Postings: For each label pair, a list of 4-byte series references
+	// with length and CRC32, plus an entry in the postings offset table
+	// (count, name, value, offset). Same for the special all-postings
+	// list.
+	postingsList := func(refs int) int { return 4 + 4 + 4*refs }
+	offsetEntry := func(name, value string) int {
+		return 1 + uvarintLen(uint64(len(name))) + len(name) + uvarintLen(uint64(len(value))) + len(value) + 4
+	}
+	c.postings = postingsList(c.series) + offsetEntry("", "")
+	for _, n := range m.names {
+		c.postings += postingsList(combinations) + offsetEntry("__name__", n)
+	}
+	if len(m.leValues) > 0 {
+		// The _bucket name has more series than the other names.
+		c.postings += 4 * combinations * (len(m.leValues) - 1)
+		for _, v := range m.leValues {
+			c.postings += postingsList(combinations) + offsetEntry("le", v)
+		}
+	}
+	for _, l := range cardinalities {
+		value := strings.Repeat("x", *labelValueLength)
+		for i := 0; i < l.values; i++ {
+			c.postings += postingsList(c.series/l.values) + offsetEntry(l.name, value)
+		}
+	}
+
+	c.idx = c.symbols + c.seriesEntries + c.postings
+
+	// Chunks: The chunk bytes per scrape are for all series of one
+	// histogram (i.e. one label combination), time stamps have to be
+	// stored once per series. Each chunk comes with an overhead of a
+	// uvarint length, the encoding byte, and a CRC32.
+	c.chunks = c.series * chunksPerSeries
+	tsBytes := *timestampBits / 8 * float64(scrapes*perCombination)
+	c.chunkBytes = int(float64(combinations)*(bytesPerScrape*float64(scrapes)+tsBytes)) + c.chunks*(2+1+4)
+	return c
+}
+
+func main() {
+	flag.Parse()
+	if len(cardinalities) == 0 {
+		log.Fatalln("--labels must describe at least one label")
+	}
+	if *nativeBytes <= 0 || *classicBytes <= 0 {
+		log.Fatalln("--native-bytes-per-scrape and --classic-bytes-per-scrape must be positive, run the scraper to find out")
+	}
+	if *scrapeInterval <= 0 || *blockDuration < *scrapeInterval || *samplesPerChunk < 1 {
+		log.Fatalln("--scrape-interval must be positive and not longer than --block-duration, --samples-per-chunk must be positive")
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		log.Fatalln("--classic-buckets must be sorted, provided value:", bounds.String())
+	}
+
+	leValues := make([]string, 0, len(bounds)+1)
+	for _, b := range bounds {
+		leValues = append(leValues, strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	leValues = append(leValues, "+Inf")
+
+	classic := model(metric{
+		names:    []string{*metricName + "_bucket", *metricName + "_sum", *metricName + "_count"},
+		leValues: leValues,
+	}, *classicBytes)
+	native := model(metric{names: []string{*metricName}}, *nativeBytes)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "\tclassic\tnative\t\n")
+	row := func(name string, c, n int) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t\n", name, c, n)
+	}
+	row("Series", classic.series, native.series)
+	row("Chunks", classic.chunks, native.chunks)
+	row("Symbol table bytes", classic.symbols, native.symbols)
+	row("Series entry bytes", classic.seriesEntries, native.seriesEntries)
+	row("Postings bytes", classic.postings, native.postings)
+	row("Index bytes", classic.idx, native.idx)
+	row("Chunk bytes", classic.chunkBytes, native.chunkBytes)
+	row("Total bytes", classic.idx+classic.chunkBytes, native.idx+native.chunkBytes)
+	w.Flush()
+
+	ct, nt := classic.idx+classic.chunkBytes, native.idx+native.chunkBytes
+	fmt.Printf(
+		"Native histograms need %.1f%% of the storage of classic histograms (index: %.1f%%, chunks: %.1f%%).\n",
+		100*float64(nt)/float64(ct), 100*float64(native.idx)/float64(classic.idx), 100*float64(native.chunkBytes)/float64(classic.chunkBytes),
+	)
+}
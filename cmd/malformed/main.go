@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	referenceName = "reference_histogram"
+	casePrefix    = "edge_case_histogram_"
+)
+
+var (
+	addr          = flag.String("listen-address", ":8080", "address to listen on for HTTP requests")
+	factor        = flag.Float64("factor", 1.1, "each bucket is by this factor wider than the previous one, must be greater 1")
+	zeroThreshold = flag.Float64("zero-threshold", 0.1, "width of the “zero” bucket")
+	listCases     = flag.Bool("list-cases", false, "list all available cases and exit")
+	selected      casesFlag
+)
+
+func init() {
+	flag.Var(&selected, "cases", "comma-separated list of cases to expose, see --list-cases (default all)")
+}
+
+type casesFlag []string
+
+func (cf *casesFlag) String() string {
+	return strings.Join(*cf, ",")
+}
+
+func (cf *casesFlag) Set(value string) error {
+	if len(*cf) > 0 {
+		return errors.New("cases flag already set")
+	}
+	for _, name := range strings.Split(value, ",") {
+		if _, ok := cases[name]; !ok {
+			return fmt.Errorf("unknown case %q", name)
+		}
+		*cf = append(*cf, name)
+	}
+	return nil
+}
+
+// edgeCase derives an invalid or unusual histogram from a valid one. The
+// provided histogram is a copy and may be modified. scrape is the number of
+// the current scrape, starting with 0.
+type edgeCase struct {
+	help   string
+	derive func(h *dto.Histogram, scrape uint64) *dto.Histogram
+}
+
+var cases = map[string]edgeCase{
+	"zero_length_span": {
+		"Invalid: a span of length zero precedes the positive spans.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.PositiveSpan = append([]*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(0)}}, h.PositiveSpan...)
+			return h
+		},
+	},
+	"zero_offset_span": {
+		"Unusual: the first positive span with more than one bucket is split into two spans, the second with offset zero.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			for i, first := range h.PositiveSpan {
+				if first.GetLength() < 2 {
+					continue
+				}
+				second := &dto.BucketSpan{Offset: proto.Int32(0), Length: proto.Uint32(first.GetLength() - 1)}
+				first.Length = proto.Uint32(1)
+				h.PositiveSpan = append(h.PositiveSpan[:i+1], append([]*dto.BucketSpan{second}, h.PositiveSpan[i+1:]...)...)
+				break
+			}
+			return h
+		},
+	},
+	"missing_delta": {
+		"Invalid: the positive spans describe one more bucket than there are deltas.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			if len(h.PositiveDelta) > 0 {
+				h.PositiveDelta = h.PositiveDelta[:len(h.PositiveDelta)-1]
+			}
+			return h
+		},
+	},
+	"extra_delta": {
+		"Invalid: there is one more positive delta than the spans describe buckets.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.PositiveDelta = append(h.PositiveDelta, 1)
+			return h
+		},
+	},
+	"negative_bucket_count": {
+		"Invalid: the first positive bucket has a negative absolute count, while all others are unchanged.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			if len(h.PositiveDelta) == 0 {
+				return h
+			}
+			d := h.PositiveDelta[0]
+			h.PositiveDelta[0] = -d
+			if len(h.PositiveDelta) > 1 {
+				h.PositiveDelta[1] += 2 * d
+			}
+			return h
+		},
+	},
+	"count_mismatch": {
+		"Invalid: the sample count is one larger than the sum of all bucket counts (with a non-NaN sum).",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.SampleCount = proto.Uint64(h.GetSampleCount() + 1)
+			return h
+		},
+	},
+	"mixed_int_float": {
+		"Invalid: float counts are set in addition to the integer counts.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.SampleCountFloat = proto.Float64(float64(h.GetSampleCount()))
+			h.ZeroCountFloat = proto.Float64(float64(h.GetZeroCount()))
+			h.PositiveCount = absoluteCounts(h.PositiveDelta)
+			h.NegativeCount = absoluteCounts(h.NegativeDelta)
+			return h
+		},
+	},
+	"huge_indices": {
+		"Unusual: the positive buckets are shifted so that the last one has the largest possible index, resulting in infinite bucket boundaries.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			if len(h.PositiveSpan) == 0 {
+				return h
+			}
+			var last int32
+			for _, s := range h.PositiveSpan {
+				last += s.GetOffset() + int32(s.GetLength())
+			}
+			last-- // Index of the last bucket.
+			first := h.PositiveSpan[0]
+			first.Offset = proto.Int32(first.GetOffset() + math.MaxInt32 - last)
+			return h
+		},
+	},
+	"nan_sum": {
+		"Valid: the sum is NaN, as it happens after observing NaN.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.SampleSum = proto.Float64(math.NaN())
+			return h
+		},
+	},
+	"inf_sum": {
+		"Valid: the sum is +Inf, as it happens after observing +Inf.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.SampleSum = proto.Float64(math.Inf(1))
+			return h
+		},
+	},
+	"nan_zero_threshold": {
+		"Invalid: the zero threshold is NaN.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.ZeroThreshold = proto.Float64(math.NaN())
+			return h
+		},
+	},
+	"schema_out_of_range": {
+		"Invalid: the schema is one larger than the maximum schema (without changing the buckets).",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			h.Schema = proto.Int32(native.MaxSchema + 1)
+			return h
+		},
+	},
+	"schema_flip": {
+		"Valid: every other scrape, the histogram is downscaled by one schema step, i.e. the schema changes with every scrape.",
+		func(h *dto.Histogram, scrape uint64) *dto.Histogram {
+			if scrape%2 == 0 || h.GetSchema() <= native.MinSchema {
+				return h
+			}
+			d, err := native.Decode(h)
+			if err != nil {
+				return h
+			}
+			d.Downscale(h.GetSchema() - 1)
+			return d.Encode()
+		},
+	},
+	"empty": {
+		"Valid: a native histogram without any observations.",
+		func(h *dto.Histogram, _ uint64) *dto.Histogram {
+			return native.New(h.GetSchema(), h.GetZeroThreshold()).Encode()
+		},
+	},
+}
+
+// absoluteCounts converts bucket deltas into absolute float counts.
+func absoluteCounts(deltas []int64) []float64 {
+	var (
+		counts       []float64
+		currentCount int64
+	)
+	for _, d := range deltas {
+		currentCount += d
+		counts = append(counts, float64(currentCount))
+	}
+	return counts
+}
+
+func observe(his prometheus.Histogram) {
+	for {
+		his.Observe(rand.NormFloat64())
+		time.Sleep(time.Duration(rand.Int31n(100)) * time.Millisecond)
+	}
+}
+
+// EdgeCaseGatherer adds a metric family for each selected edge case, derived
+// from the reference histogram gathered by the wrapped Gatherer.
+type EdgeCaseGatherer struct {
+	prometheus.Gatherer
+	cases  []string
+	scrape atomic.Uint64
+}
+
+func (g *EdgeCaseGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if err != nil {
+		return mfs, err
+	}
+	if len(mfs) == 0 {
+		return nil, errors.New("reference histogram not found")
+	}
+	scrape := g.scrape.Add(1) - 1
+	reference := mfs[0]
+
+	for _, name := range g.cases {
+		c := cases[name]
+		mf := proto.Clone(reference).(*dto.MetricFamily)
+		mf.Name = proto.String(casePrefix + name)
+		mf.Help = proto.String(c.help)
+		m := mf.Metric[0]
+		m.Histogram = c.derive(m.Histogram, scrape)
+		mfs = append(mfs, mf)
+	}
+	return mfs, nil
+}
+
+func main() {
+	flag.Parse()
+	if *factor <= 1 {
+		log.Fatalln("--factor must by greater than 1, provided value:", *factor)
+	}
+
+	names := make([]string, 0, len(cases))
+	for name := range cases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if *listCases {
+		for _, name := range names {
+			fmt.Fprintf(os.Stdout, "%s%s: %s\n", casePrefix, name, cases[name].help)
+		}
+		return
+	}
+	if len(selected) == 0 {
+		selected = names
+	}
+
+	// The reference histogram is registered before serving metrics, so
+	// that every scrape finds it.
+	reg := prometheus.NewRegistry()
+	his := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:                         referenceName,
+		Help:                         "Valid histogram from which all edge cases are derived.",
+		NativeHistogramBucketFactor:  *factor,
+		NativeHistogramZeroThreshold: *zeroThreshold,
+	})
+	http.Handle("/metrics", promhttp.HandlerFor(&EdgeCaseGatherer{Gatherer: reg, cases: selected}, promhttp.HandlerOpts{}))
+
+	go observe(his)
+
+	log.Println("Serving metrics, SIGTERM to abort…")
+	http.ListenAndServe(*addr, nil)
+}
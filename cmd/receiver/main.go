@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/beorn7/histogram_experiments/remote"
+)
+
+var (
+	addr   = flag.String("listen-address", ":9201", "address to listen on for remote-write requests")
+	decode = flag.Bool("decode", false, "print every received histogram sample")
+)
+
+// receiver checks incoming remote-write requests and keeps statistics about
+// them. If the sender ships the scraped histograms out of band (see
+// serveExpected), each received sample is also compared with the histogram it
+// has been created from.
+type receiver struct {
+	mtx      sync.Mutex
+	lastTS   map[string]int64 // Time stamp of the last sample, by series.
+	total    [3]remote.Stats  // Indexed by protocol version.
+	requests [3]int
+	problems int
+
+	// Expected samples not received yet, by expectedKey. Nil until the
+	// first expected samples have arrived.
+	expected         map[string]remote.Sample
+	matched, missing int
+}
+
+func expectedKey(s remote.Sample) string {
+	return fmt.Sprint(s.Labels, "@", s.Timestamp)
+}
+
+// serveExpected accepts the scraped histograms the sender is about to send.
+func (rcv *receiver) serveExpected(w http.ResponseWriter, r *http.Request) {
+	samples, err := remote.DecodeExpected(r)
+	if err != nil {
+		log.Println("Could not decode expected histograms:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+
+	if rcv.expected == nil {
+		rcv.expected = map[string]remote.Sample{}
+	}
+	for _, s := range samples {
+		rcv.expected[expectedKey(s)] = s
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	samples, version, stats, err := remote.DecodeRequest(r)
+	if err != nil {
+		log.Println("Could not decode request:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+
+	var maxTS int64
+	for _, s := range samples {
+		maxTS = max(maxTS, s.Timestamp)
+		for _, problem := range rcv.check(s) {
+			rcv.problems++
+			log.Println("Problem with sample for", s.Labels, "at", s.Timestamp, ":", problem)
+		}
+		if *decode {
+			if s.H != nil {
+				fmt.Println(s.Labels, s.Timestamp, s.H)
+			} else {
+				fmt.Println(s.Labels, s.Timestamp, s.FH)
+			}
+		}
+	}
+
+	// The sender ships the expected histograms before the request, so
+	// those up to the time stamps of this request are never going to
+	// arrive anymore.
+	for key, s := range rcv.expected {
+		if s.Timestamp <= maxTS {
+			rcv.problems++
+			rcv.missing++
+			log.Println("Problem with sample for", s.Labels, "at", s.Timestamp, ": scraped, but not received")
+			delete(rcv.expected, key)
+		}
+	}
+
+	rcv.requests[version]++
+	t := &rcv.total[version]
+	t.Samples += stats.Samples
+	t.Compressed += stats.Compressed
+	t.Uncompressed += stats.Uncompressed
+	log.Printf(
+		"Received remote-write %d.0 request: %d histograms, %d bytes compressed (%d uncompressed), %.1f bytes per sample. Total: %d requests, %.1f bytes per sample, %d problems.",
+		version, stats.Samples, stats.Compressed, stats.Uncompressed, stats.BytesPerSample(),
+		rcv.requests[version], t.BytesPerSample(), rcv.problems,
+	)
+	if rcv.expected != nil {
+		log.Printf("Compared with the scraped histograms: %d matched, %d missing.", rcv.matched, rcv.missing)
+	}
+
+	if version == remote.Version2 {
+		remote.SetWrittenHeader(w, len(samples))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// check returns the problems found with s, which are the same ones that would
+// make Prometheus reject the sample.
+func (rcv *receiver) check(s remote.Sample) []error {
+	var problems []error
+	if s.Labels.Get(labels.MetricName) == "" {
+		problems = append(problems, fmt.Errorf("no %s label", labels.MetricName))
+	}
+	prevName := ""
+	s.Labels.Range(func(l labels.Label) {
+		if prevName != "" && l.Name <= prevName {
+			problems = append(problems, fmt.Errorf("labels not sorted or duplicate label name %q", l.Name))
+		}
+		prevName = l.Name
+	})
+	var err error
+	if s.H != nil {
+		err = s.H.Validate()
+	} else {
+		err = s.FH.Validate()
+	}
+	if err != nil {
+		problems = append(problems, err)
+	}
+	key := s.Labels.String()
+	if last, ok := rcv.lastTS[key]; ok && s.Timestamp <= last {
+		problems = append(problems, fmt.Errorf("time stamp not after previous time stamp %d", last))
+	}
+	rcv.lastTS[key] = s.Timestamp
+
+	if rcv.expected != nil {
+		want, ok := rcv.expected[expectedKey(s)]
+		switch {
+		case !ok:
+			problems = append(problems, errors.New("not among the scraped histograms"))
+		case !s.Equal(want):
+			problems = append(problems, fmt.Errorf("differs from the scraped histogram %v, received %v", histogramString(want), histogramString(s)))
+		default:
+			rcv.matched++
+		}
+		delete(rcv.expected, expectedKey(s))
+	}
+	return problems
+}
+
+func histogramString(s remote.Sample) string {
+	if s.H != nil {
+		return s.H.String()
+	}
+	return s.FH.String()
+}
+
+func main() {
+	flag.Parse()
+
+	rcv := &receiver{lastTS: map[string]int64{}}
+	http.Handle("/api/v1/write", rcv)
+	http.HandleFunc("/expected", rcv.serveExpected)
+
+	log.Println("Receiving remote-write requests on /api/v1/write and scraped histograms to compare them with on /expected, SIGTERM to abort…")
+	log.Println(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var compareClassic = flag.Bool("compare-classic", false, "For histograms that contain classic buckets in addition to native buckets, check that both representations agree and report their cost side by side.")
+
+// CompareClassic checks the classic buckets of h against its native buckets
+// (decoded as d) and reports the cost of both representations. Count and sum
+// are shared by both representations in the protobuf format, so what is
+// checked is that the native buckets add up to the count, that the classic
+// buckets are cumulative and don't exceed the count, and that each classic
+// bucket count lies within the range allowed by the native buckets. (The
+// native buckets can only bound the classic bucket count because a native
+// bucket might straddle the classic upper bound.) It returns the number of
+// inconsistencies found.
+func CompareClassic(h *dto.Histogram, d *native.Histogram, o io.Writer) int {
+	if len(h.GetBucket()) == 0 {
+		return 0
+	}
+	var (
+		problems int
+		prev     float64
+		count    = d.Count
+	)
+	problem := func(format string, args ...any) {
+		problems++
+		fmt.Fprintf(o, "  INCONSISTENT: "+format+"\n", args...)
+	}
+
+	classicOnly, nativeOnly := splitRepresentations(h)
+	classicBytes, err := proto.Marshal(classicOnly)
+	if err != nil {
+		panic(err)
+	}
+	nativeBytes, err := proto.Marshal(nativeOnly)
+	if err != nil {
+		panic(err)
+	}
+	classicSeries := len(h.GetBucket()) + 2 // Plus _sum and _count.
+	if !math.IsInf(h.GetBucket()[len(h.GetBucket())-1].GetUpperBound(), 1) {
+		classicSeries++ // Implicit +Inf bucket.
+	}
+	nNative := len(d.Positive) + len(d.Negative) + 1
+
+	fmt.Fprintln(o, "- Classic vs. native representation:")
+	fmt.Fprintf(o, "  Buckets: %d classic, %d native (incl. zero bucket)\n", len(h.GetBucket()), nNative)
+	fmt.Fprintf(o, "  Bytes on the wire: %d classic, %d native\n", len(classicBytes), len(nativeBytes))
+	fmt.Fprintf(o, "  Samples to store per scrape: %d classic (one series each), 1 native\n", classicSeries)
+
+	lo, hi := d.CumulativeCountBounds(math.Inf(1))
+	if hi != count && !(math.IsNaN(d.Sum) && hi < count) {
+		problem("native buckets add up to %g, but the count is %g", hi, count)
+	}
+	for _, b := range h.GetBucket() {
+		le := b.GetUpperBound()
+		c := float64(b.GetCumulativeCount())
+		if b.CumulativeCountFloat != nil {
+			c = b.GetCumulativeCountFloat()
+		}
+		lo, hi = d.CumulativeCountBounds(le)
+		status := "ok"
+		if c < lo || c > hi {
+			status = "MISMATCH"
+			problems++
+		}
+		fmt.Fprintf(o, "  le=%g: classic %g, native [%g, %g] %s\n", le, c, lo, hi, status)
+		if c < prev {
+			problem("cumulative count %g for le=%g is lower than the previous one (%g)", c, le, prev)
+		}
+		if c > count {
+			problem("cumulative count %g for le=%g exceeds the count %g", c, le, count)
+		}
+		prev = c
+	}
+	if problems == 0 {
+		fmt.Fprintln(o, "  Both representations are consistent.")
+	} else {
+		fmt.Fprintln(o, "  Inconsistencies found:", problems)
+	}
+	return problems
+}
+
+// splitRepresentations returns copies of h, one with only the classic buckets
+// and one with only the native buckets. Fields shared by both representations
+// (count, sum, created time stamp, exemplars) are present in both.
+func splitRepresentations(h *dto.Histogram) (classicOnly, nativeOnly *dto.Histogram) {
+	classicOnly = proto.Clone(h).(*dto.Histogram)
+	classicOnly.Schema = nil
+	classicOnly.ZeroThreshold = nil
+	classicOnly.ZeroCount = nil
+	classicOnly.ZeroCountFloat = nil
+	classicOnly.NegativeSpan = nil
+	classicOnly.NegativeDelta = nil
+	classicOnly.NegativeCount = nil
+	classicOnly.PositiveSpan = nil
+	classicOnly.PositiveDelta = nil
+	classicOnly.PositiveCount = nil
+
+	nativeOnly = proto.Clone(h).(*dto.Histogram)
+	nativeOnly.Bucket = nil
+	return classicOnly, nativeOnly
+}
+
+// ClassicStorage is a fake storage modeling the cost of storing the classic
+// buckets of a histogram the way Prometheus does, i.e. as one float series per
+// bucket (including +Inf) plus the _sum and _count series.
+type ClassicStorage struct {
+	// Storage collects the frequencies of the ΔΔ values of all bucket
+	// series and the _count series (which are all integer counters), so
+	// that the same bit-bucket estimate as for native histograms can be
+	// applied. (Only freq3 and n are used.)
+	Storage
+	series map[string]*classicSeries // Keyed by "le=…", "count", or "sum".
+}
+
+type classicSeries struct {
+	last, lastΔ int64 // Not used for the _sum series.
+	xor         xorState
+}
+
+func NewClassicStorage() *ClassicStorage {
+	return &ClassicStorage{
+		Storage: Storage{freq3: map[int64]uint{}},
+		series:  map[string]*classicSeries{},
+	}
+}
+
+// Track adds the classic buckets, count, and sum of h to the ClassicStorage.
+// The ΔΔ model only applies to integer counters, so an error is returned (and
+// nothing is tracked) if any of the counts is not integral, as it might be for
+// a float histogram.
+func (cs *ClassicStorage) Track(h *dto.Histogram) error {
+	bounds, cumCounts := classicBuckets(h)
+	count := histogramCount(h)
+	for i, c := range append(cumCounts, count) {
+		if c != math.Trunc(c) {
+			le := math.Inf(1)
+			if i < len(bounds) {
+				le = bounds[i]
+			}
+			return fmt.Errorf("non-integral cumulative count %g for le=%g", c, le)
+		}
+	}
+
+	cs.n++
+	counter := func(name string, v float64) {
+		s := cs.get(name)
+		s.xor.add(v)
+		c := int64(v)
+		Δ := c - s.last
+		cs.freq3[Δ-s.lastΔ]++
+		s.last, s.lastΔ = c, Δ
+	}
+	for i, le := range bounds {
+		counter(fmt.Sprint("le=", le), cumCounts[i])
+	}
+	counter("le=+Inf", count)
+	counter("count", count)
+	cs.get("sum").xor.add(h.GetSampleSum())
+	return nil
+}
+
+func (cs *ClassicStorage) get(name string) *classicSeries {
+	s := cs.series[name]
+	if s == nil {
+		s = &classicSeries{}
+		cs.series[name] = s
+	}
+	return s
+}
+
+// ReportClassicStorageStats reports the number of series and the modeled
+// storage cost of the classic buckets tracked in cs: the XOR encoding of the
+// values as Prometheus uses it for float samples, and (if bit buckets are
+// configured) the same ΔΔ bit-bucket estimate as used for native histograms.
+// Time stamps are not included in either number, but note that they have to
+// be stored once per series, i.e. once per bucket.
+func ReportClassicStorageStats(cs *ClassicStorage, o io.Writer) {
+	var xorBits uint
+	for _, s := range cs.series {
+		xorBits += s.xor.bits
+	}
+	fmt.Fprintf(o, "- Classic representation: %d series (vs. 1 native series)\n", len(cs.series))
+	fmt.Fprintf(
+		o, "  XOR-encoded values of all series: %d bytes (%.1f bytes per scrape)\n",
+		xorBits/8, float64(xorBits)/8/float64(cs.n),
+	)
+	if len(bitBuckets) == 0 || bitBuckets[0] == 0 {
+		return
+	}
+	bits := ReportBitBucketStats(&cs.Storage, bitBuckets, ioutil.Discard)
+	sumBits := cs.series["sum"].xor.bits
+	fmt.Fprintf(
+		o, "  ΔΔ values of bucket and count series with bit buckets, plus XOR-encoded sum: %d bytes (%.1f bytes per scrape)\n",
+		(bits+sumBits)/8, float64(bits+sumBits)/8/float64(cs.n),
+	)
+}
+
+// xorState tracks the bits needed for the XOR encoding of float values as
+// described in the Gorilla paper and implemented in Prometheus.
+type xorState struct {
+	n                 int
+	last              uint64
+	leading, trailing uint8
+	bits              uint
+}
+
+func (x *xorState) add(v float64) {
+	cur := math.Float64bits(v)
+	defer func() { x.n++; x.last = cur }()
+	if x.n == 0 {
+		x.bits += 64
+		x.leading = 0xff // No window yet.
+		return
+	}
+	delta := cur ^ x.last
+	if delta == 0 {
+		x.bits++
+		return
+	}
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	if leading >= 32 {
+		leading = 31 // Only 5 bits to store the number of leading zeros.
+	}
+	if x.leading != 0xff && leading >= x.leading && trailing >= x.trailing {
+		// Reuse the previous window.
+		x.bits += 2 + uint(64-x.leading-x.trailing)
+		return
+	}
+	x.leading, x.trailing = leading, trailing
+	x.bits += 2 + 5 + 6 + uint(64-leading-trailing)
+}
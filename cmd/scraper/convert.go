@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	convert        = flag.String("convert", "", "If 'classic', convert every scraped native histogram into a classic histogram with the buckets given by --convert-buckets. If 'native', convert every scraped classic histogram into a native histogram with the nearest schema. The result is printed as a new exposition, together with error statistics.")
+	convertBuckets = floatsFlag(prometheus.DefBuckets)
+)
+
+func init() {
+	flag.Var(&convertBuckets, "convert-buckets", "Comma-separated list of upper bounds of the classic buckets to convert native histograms into, see --convert.")
+}
+
+type floatsFlag []float64
+
+func (ff *floatsFlag) String() string {
+	return fmt.Sprint(*ff)
+}
+
+func (ff *floatsFlag) Set(value string) error {
+	*ff = nil
+	for _, ft := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(ft, 64)
+		if err != nil {
+			return err
+		}
+		*ff = append(*ff, f)
+	}
+	return nil
+}
+
+// Convert converts the histogram in metric m of metric family mf as configured
+// by --convert and prints the result as an exposition in the text format (for
+// classic histograms) or the protobuf text format (for native histograms),
+// followed by error statistics. Histograms without the representation to
+// convert from are ignored.
+func Convert(mf *dto.MetricFamily, m *dto.Metric, o io.Writer) error {
+	h := m.GetHistogram()
+	var (
+		converted *dto.Histogram
+		format    expfmt.Format
+		report    func()
+	)
+	switch *convert {
+	case "classic":
+		if !IsNative(h) {
+			return nil
+		}
+		d, err := native.Decode(h)
+		if err != nil {
+			return err
+		}
+		converted = toClassic(d)
+		format = expfmt.NewFormat(expfmt.TypeTextPlain)
+		report = func() { reportClassicErrors(h, d, o) }
+	case "native":
+		if len(h.GetBucket()) == 0 {
+			return nil
+		}
+		bounds, cumCounts := classicBuckets(h)
+		d := native.FromClassic(bounds, cumCounts, histogramCount(h), h.GetSampleSum(), native.NearestSchema(bounds))
+		converted = d.Encode()
+		format = expfmt.NewFormat(expfmt.TypeProtoText)
+		report = func() { reportNativeErrors(h, d, bounds, cumCounts, o) }
+	default:
+		return fmt.Errorf("unknown conversion %q", *convert)
+	}
+
+	cmf := proto.Clone(mf).(*dto.MetricFamily)
+	cm := proto.Clone(m).(*dto.Metric)
+	cm.Histogram = converted
+	cmf.Metric = []*dto.Metric{cm}
+	fmt.Fprintf(o, "### Converted to %s histogram: %s%s\n", *convert, mf.GetName(), m.GetLabel())
+	if err := expfmt.NewEncoder(o, format).Encode(cmf); err != nil {
+		return err
+	}
+	report()
+	return nil
+}
+
+// histogramCount returns the sample count of h, no matter if it is an integer
+// or a float histogram.
+func histogramCount(h *dto.Histogram) float64 {
+	if h.SampleCountFloat != nil {
+		return h.GetSampleCountFloat()
+	}
+	return float64(h.GetSampleCount())
+}
+
+// classicBuckets returns the upper bounds and cumulative counts of the classic
+// buckets of h, excluding an explicit +Inf bucket.
+func classicBuckets(h *dto.Histogram) (bounds, cumCounts []float64) {
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		c := float64(b.GetCumulativeCount())
+		if b.CumulativeCountFloat != nil {
+			c = b.GetCumulativeCountFloat()
+		}
+		bounds = append(bounds, b.GetUpperBound())
+		cumCounts = append(cumCounts, c)
+	}
+	return bounds, cumCounts
+}
+
+// toClassic returns a classic histogram with the buckets from
+// --convert-buckets, estimated from d. The estimated counts are rounded to
+// integers, as the text format doesn't support float histograms. (Rounding
+// keeps the cumulative counts monotonic.)
+func toClassic(d *native.Histogram) *dto.Histogram {
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(uint64(math.Round(d.Count))),
+		SampleSum:   proto.Float64(d.Sum),
+	}
+	for i, c := range d.ToClassic(convertBuckets) {
+		h.Bucket = append(h.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(convertBuckets[i]),
+			CumulativeCount: proto.Uint64(uint64(math.Round(c))),
+		})
+	}
+	return h
+}
+
+// errorSummary describes n bucket count errors by their maximum (also relative
+// to count) and their mean. Whatever cannot be calculated for lack of buckets
+// or observations is reported as n/a.
+func errorSummary(maxErr, sumErr, count float64, n int) string {
+	if n == 0 {
+		return "n/a (no buckets)"
+	}
+	relErr := "n/a"
+	if count > 0 {
+		relErr = fmt.Sprintf("%.2f%%", 100*maxErr/count)
+	}
+	return fmt.Sprintf("max %g (%s of count), mean %g", maxErr, relErr, sumErr/float64(n))
+}
+
+// reportClassicErrors reports the worst-case error of the classic buckets
+// estimated from d, as given by the range of counts compatible with the native
+// buckets. If h also contains classic buckets with the same bounds, the actual
+// error is reported, too.
+func reportClassicErrors(h *dto.Histogram, d *native.Histogram, o io.Writer) {
+	var maxErr, sumErr float64
+	for _, le := range convertBuckets {
+		est := d.CumulativeCount(le)
+		lo, hi := d.CumulativeCountBounds(le)
+		err := math.Max(est-lo, hi-est)
+		maxErr = math.Max(maxErr, err)
+		sumErr += err
+	}
+	fmt.Fprintln(o, "- Worst-case error of estimated bucket counts:", errorSummary(maxErr, sumErr, d.Count, len(convertBuckets)))
+
+	bounds, cumCounts := classicBuckets(h)
+	if len(bounds) != len(convertBuckets) {
+		return
+	}
+	for i, le := range bounds {
+		if le != convertBuckets[i] {
+			return
+		}
+	}
+	maxErr, sumErr = 0, 0
+	for i, est := range d.ToClassic(bounds) {
+		err := math.Abs(est - cumCounts[i])
+		maxErr = math.Max(maxErr, err)
+		sumErr += err
+	}
+	fmt.Fprintln(o, "- Actual error compared to scraped classic buckets:", errorSummary(maxErr, sumErr, d.Count, len(bounds)))
+}
+
+// reportNativeErrors reports the error of the native histogram d converted
+// from the classic buckets of h, by converting d back into the original
+// classic buckets. If h also contains native buckets, the configured
+// quantiles of both native histograms are reported side by side.
+func reportNativeErrors(h *dto.Histogram, d *native.Histogram, bounds, cumCounts []float64, o io.Writer) {
+	var maxErr, sumErr float64
+	for i, est := range d.ToClassic(bounds) {
+		err := math.Abs(est - cumCounts[i])
+		maxErr = math.Max(maxErr, err)
+		sumErr += err
+	}
+	fmt.Fprintf(o, "- Schema %d, zero threshold %g, %d buckets\n", d.Schema, d.ZeroThreshold, len(native.SortedIndices(d.Positive))+len(native.SortedIndices(d.Negative))+1)
+	fmt.Fprintln(o, "- Round-trip error of classic bucket counts:", errorSummary(maxErr, sumErr, d.Count, len(bounds)))
+
+	if !IsNative(h) {
+		return
+	}
+	scraped, err := native.Decode(h)
+	if err != nil {
+		return
+	}
+	for _, q := range quantiles {
+		fmt.Fprintf(o, "- q=%g: converted %g, scraped native %g\n", q, d.Quantile(q), scraped.Quantile(q))
+	}
+}
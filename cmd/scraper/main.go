@@ -10,14 +10,21 @@ import (
 	"math"
 	"math/bits"
 	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/prom2json"
 
+	"github.com/beorn7/histogram_experiments/block"
+	"github.com/beorn7/histogram_experiments/native"
+	"github.com/beorn7/histogram_experiments/remote"
+	"github.com/beorn7/histogram_experiments/validate"
+
 	dto "github.com/prometheus/client_model/go"
 )
 
@@ -27,9 +34,11 @@ var (
 	decode       = flag.Bool("decode", false, "Decode scraped histogram and dump to stdout.")
 	interval     = flag.Duration("scrape-interval", 0, "If 0, scrape once and exit. Otherwise, continuously scrape with this interval.")
 	storeBuckets = flag.Bool("store-bucket-count", false, "Rather than ΔΔ-encode the Δ-values of buckets, first reconstruct the absolute count of each bucket and ΔΔ-encode the latter.")
+	validateAll  = flag.Bool("validate", false, "Check every scraped native histogram for conformance, report all problems found, and skip further processing of non-conforming histograms.")
 	bitBuckets   bitBucketsFlag
 
-	storages = map[string]*Storage{} // A Storage for each histogram, keyed by name + string representation of labels.
+	storages        = map[string]*Storage{}        // A Storage for each histogram, keyed by name + string representation of labels.
+	classicStorages = map[string]*ClassicStorage{} // A ClassicStorage for each histogram with classic buckets, keyed like storages.
 )
 
 func init() {
@@ -98,19 +107,55 @@ func main() {
 	if flag.NArg() != 1 {
 		log.Fatalf("Need exactly one argument.\n%s", usage)
 	}
+	if *remoteWriteVersion != remote.Version1 && *remoteWriteVersion != remote.Version2 {
+		log.Fatalln("--remote-write-version must be 1 or 2, provided value:", *remoteWriteVersion)
+	}
+	if *convert != "" && *convert != "classic" && *convert != "native" {
+		log.Fatalln("--convert must be 'classic' or 'native', provided value:", *convert)
+	}
+	if !sort.Float64sAreSorted(convertBuckets) {
+		log.Fatalln("--convert-buckets must be sorted, provided value:", convertBuckets.String())
+	}
+	if *tsdbDir != "" {
+		var err error
+		if tsdbWriter, err = block.NewWriter(*tsdbDir, 2*time.Hour); err != nil {
+			log.Fatalln("Could not create TSDB block writer:", err)
+		}
+	}
 	if *interval == 0 {
 		Scrape(arg)
+		exit()
 		return
 	}
 	ticker := time.NewTicker(*interval)
 	defer ticker.Stop()
+	term := make(chan os.Signal, 1)
+	if tsdbWriter != nil {
+		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	}
 	for {
 		Scrape(arg)
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-term:
+			exit()
+			return
+		}
+	}
+}
+
+// exit performs the final reporting before the scraper terminates.
+func exit() {
+	if tsdbWriter == nil {
+		return
+	}
+	if err := FlushTSDB(os.Stdout); err != nil {
+		log.Fatalln("Could not write TSDB block:", err)
 	}
 }
 
 func Scrape(url string) {
+	ts := time.Now()
 	mfChan := make(chan *dto.MetricFamily, 1024)
 	go func() {
 		err := prom2json.FetchMetricFamilies(url, mfChan, nil)
@@ -121,54 +166,170 @@ func Scrape(url string) {
 
 	for mf := range mfChan {
 		if mf.GetType() == dto.MetricType_HISTOGRAM {
+			// Estimated bytes per scrape summed up over all native
+			// histograms of the family, to compare e.g. the cost of
+			// many per-instance histograms with an aggregated one.
+			var (
+				familyBytes      float64
+				familyHistograms int
+			)
 			for _, m := range mf.GetMetric() {
 				h := m.GetHistogram()
-				if h.GetSbZeroThreshold() > 0 {
-					key := fmt.Sprint(mf.GetName(), m.GetLabel())
-					fmt.Println("### Found sparse histogram:", key)
-					buf, err := proto.Marshal(h)
-					if err != nil {
-						panic(err)
+				if *convert != "" {
+					if err := Convert(mf, m, os.Stdout); err != nil {
+						log.Println("Could not convert histogram:", err)
 					}
-					fmt.Println("- Bytes in Histogram message on the wire:", len(buf))
-					if *decode || *interval != 0 {
-						dump := ioutil.Discard
-						if *decode {
-							dump = os.Stdout
-						}
-						s := storages[key]
-						if s == nil {
-							s = NewStorage()
-							storages[key] = s
+				}
+				key := fmt.Sprint(mf.GetName(), m.GetLabel())
+				if !IsNative(h) {
+					// Histograms with only classic buckets are
+					// tracked as a baseline, too.
+					if len(h.GetBucket()) > 0 && (*decode || *interval != 0) {
+						fmt.Println("### Found classic histogram:", key)
+						TrackClassic(key, h)
+					}
+					continue
+				}
+				fmt.Println("### Found native histogram:", key)
+				buf, err := proto.Marshal(h)
+				if err != nil {
+					panic(err)
+				}
+				fmt.Println("- Bytes in Histogram message on the wire:", len(buf))
+				if *validateAll {
+					problems := validate.Histogram(h)
+					for _, p := range problems {
+						fmt.Println("- Conformance problem:", p)
+					}
+					if len(problems) > 0 {
+						continue
+					}
+				}
+				if *compareClassic {
+					if d, err := native.Decode(h); err != nil {
+						log.Println("Could not decode histogram", key, ":", err)
+					} else {
+						CompareClassic(h, d, os.Stdout)
+					}
+				}
+				if err := AppendToTSDB(key, mf, m, ts); err != nil {
+					log.Fatalln("Could not append to TSDB:", err)
+				}
+				AddRemoteSample(mf, m, ts)
+				if *decode || *interval != 0 {
+					dump := ioutil.Discard
+					if *decode {
+						dump = os.Stdout
+					}
+					s := storages[key]
+					if s == nil {
+						s = NewStorage()
+						storages[key] = s
+					}
+					if err := DumpAndTrack(h, s, dump); err != nil {
+						log.Println("Could not track histogram", key, ":", err)
+						continue
+					}
+					if *interval != 0 {
+						if len(bitBuckets) == 0 {
+							ReportFrequencyStats(s, os.Stdout)
+						} else if bitBuckets[0] == 0 {
+							BruteForceBitBucketSearch(s, os.Stdout)
+						} else {
+							bits := ReportBitBucketStats(s, bitBuckets, os.Stdout)
+							familyBytes += float64(bits) / 8 / float64(s.n)
+							familyHistograms++
 						}
-						DumpAndTrack(h, s, dump)
-						if *interval != 0 {
-							if len(bitBuckets) == 0 {
-								ReportFrequencyStats(s, os.Stdout)
-							} else if bitBuckets[0] == 0 {
-								BruteForceBitBucketSearch(s, os.Stdout)
-							} else {
-								ReportBitBucketStats(s, bitBuckets, os.Stdout)
-							}
+					}
+					TrackClassic(key, h)
+					if *interval != 0 {
+						d, err := native.Decode(h)
+						if err != nil {
+							log.Println("Could not decode histogram", key, ":", err)
+							continue
 						}
+						ReportIntervalQuantiles(key, d, ts, os.Stdout)
 					}
 				}
 			}
+			if familyHistograms > 1 {
+				fmt.Printf(
+					"### Total for %d native histograms of %s: %.1f bytes per scrape for ΔΔ(Δ) values\n",
+					familyHistograms, mf.GetName(), familyBytes,
+				)
+			}
 		}
 	}
+	if err := CommitToTSDB(); err != nil {
+		log.Fatalln("Could not commit to TSDB:", err)
+	}
+	if err := SendRemoteSamples(os.Stdout); err != nil {
+		log.Println("Could not send remote-write request:", err)
+	}
+}
+
+// TrackClassic tracks the classic buckets of h (if any) in the ClassicStorage
+// for key and, when scraping continuously, reports the storage stats.
+func TrackClassic(key string, h *dto.Histogram) {
+	if len(h.GetBucket()) == 0 {
+		return
+	}
+	cs := classicStorages[key]
+	if cs == nil {
+		cs = NewClassicStorage()
+		classicStorages[key] = cs
+	}
+	if err := cs.Track(h); err != nil {
+		log.Println("Could not track classic buckets of", key, ":", err)
+		return
+	}
+	if *interval != 0 {
+		ReportClassicStorageStats(cs, os.Stdout)
+	}
+}
+
+// IsNative returns true if h contains a native histogram (possibly in addition
+// to classic buckets). This is the same heuristic Prometheus uses: A native
+// histogram has at least one span or a zero bucket, the latter being
+// recognizable by a non-zero threshold or count.
+func IsNative(h *dto.Histogram) bool {
+	return len(h.GetPositiveSpan()) > 0 || len(h.GetNegativeSpan()) > 0 ||
+		h.GetZeroThreshold() > 0 || h.GetZeroCount() > 0 || h.GetZeroCountFloat() > 0
 }
 
-func DumpAndTrack(h *dto.Histogram, s *Storage, dump io.Writer) {
+// DumpAndTrack dumps the buckets of h to dump and tracks them in s. It returns
+// an error (without tracking anything) if the spans of h describe more buckets
+// than there are deltas, which would otherwise make it index out of range.
+func DumpAndTrack(h *dto.Histogram, s *Storage, dump io.Writer) error {
+	for _, sd := range []struct {
+		sign   string
+		spans  []*dto.BucketSpan
+		deltas []int64
+	}{
+		{"positive", h.GetPositiveSpan(), h.GetPositiveDelta()},
+		{"negative", h.GetNegativeSpan(), h.GetNegativeDelta()},
+	} {
+		var n uint64
+		for _, span := range sd.spans {
+			n += uint64(span.GetLength())
+		}
+		if n > uint64(len(sd.deltas)) {
+			return fmt.Errorf("%s spans describe %d buckets, but there are only %d deltas", sd.sign, n, len(sd.deltas))
+		}
+	}
+
 	s.n++
 	separator := "  ----------------------------------------------------------------------\n"
-	resolution := int32(h.GetSbResolution())
-	threshold := h.GetSbZeroThreshold()
+	schema := h.GetSchema()
+	threshold := h.GetZeroThreshold()
 	bound := func(i int32) float64 {
 		var result float64
-		if i%resolution == 0 {
-			result = float64(math.Pow10(int(i / resolution)))
+		if schema <= 0 {
+			result = math.Ldexp(1, int(i)<<-schema)
+		} else if i%(1<<schema) == 0 {
+			result = math.Ldexp(1, int(i>>schema))
 		} else {
-			result = math.Pow(10, float64(i)/float64(resolution))
+			result = math.Exp2(float64(i) / float64(int32(1)<<schema))
 		}
 		if result < threshold {
 			return threshold
@@ -180,28 +341,30 @@ func DumpAndTrack(h *dto.Histogram, s *Storage, dump io.Writer) {
 		// - Only start a new one if really needed (i.e. an actual gap).
 		// - No zero length spans.
 		// - Total length of spans == length of deltas.
-		// A robust implementation should handle degenerate cases gracefully.
+		// Use the --validate flag to skip histograms violating these
+		// assumptions (rather than dumping garbage). Too few deltas
+		// have been ruled out above.
 		var (
 			lines    []string
 			curIdx   int32
 			deltaPos int
-			curCount = int64(h.GetSbZeroCount())
+			curCount int64
 		)
-		buckets := h.GetSbPositive()
+		spans, deltas := h.GetPositiveSpan(), h.GetPositiveDelta()
 		old1, old2 := s.p1, s.p2
 		if negative {
-			buckets = h.GetSbNegative()
+			spans, deltas = h.GetNegativeSpan(), h.GetNegativeDelta()
 			old1, old2 = s.n1, s.n2
 		}
 		new1, new2 := map[int32]int64{}, map[int32]int64{}
 
-		for _, span := range buckets.GetSpan() {
+		for _, span := range spans {
 			curIdx += span.GetOffset()
 			if bound(curIdx-1) > threshold {
 				lines = append(lines, separator)
 			}
 			for nextIdx := curIdx + int32(span.GetLength()); curIdx < nextIdx; curIdx++ {
-				bucketΔ := buckets.GetDelta()[deltaPos]
+				bucketΔ := deltas[deltaPos]
 				deltaPos++
 				curCount += bucketΔ
 
@@ -252,13 +415,13 @@ func DumpAndTrack(h *dto.Histogram, s *Storage, dump io.Writer) {
 		}
 	}
 
-	nBuckets := len(h.GetSbNegative().GetDelta()) + 1 + len(h.GetSbPositive().GetDelta())
-	nSpans := len(h.GetSbNegative().GetSpan()) + len(h.GetSbPositive().GetSpan())
+	nBuckets := len(h.GetNegativeDelta()) + 1 + len(h.GetPositiveDelta())
+	nSpans := len(h.GetNegativeSpan()) + len(h.GetPositiveSpan())
 	fmt.Fprintln(dump, "-", nBuckets, "buckets /", nSpans, "spans:")
 	signedDump(true)
-	fmt.Fprintln(dump, " ", -h.GetSbZeroThreshold(), "≤ x ≤", h.GetSbZeroThreshold(), "→", h.GetSbZeroCount())
+	fmt.Fprintln(dump, " ", -h.GetZeroThreshold(), "≤ x ≤", h.GetZeroThreshold(), "→", h.GetZeroCount())
 	signedDump(false)
-
+	return nil
 }
 
 func ReportFrequencyStats(s *Storage, o io.Writer) {
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beorn7/histogram_experiments/native"
+)
+
+var (
+	quantiles quantilesFlag = []float64{0.5, 0.9, 0.99}
+
+	lastScrapes = map[string]lastScrape{} // The last scrape of each histogram, keyed like storages.
+)
+
+func init() {
+	flag.Var(&quantiles, "quantiles", "Comma-separated list of quantiles to estimate from the increase between consecutive scrapes (like a dashboard would do with rate). Only used if --scrape-interval is set. Set to the empty string to not estimate any quantiles.")
+}
+
+type quantilesFlag []float64
+
+func (qf *quantilesFlag) String() string {
+	return fmt.Sprint(*qf)
+}
+
+func (qf *quantilesFlag) Set(value string) error {
+	*qf = nil
+	if value == "" {
+		return nil
+	}
+	for _, qt := range strings.Split(value, ",") {
+		q, err := strconv.ParseFloat(qt, 64)
+		if err != nil {
+			return err
+		}
+		if q < 0 || q > 1 {
+			return errors.New("quantiles must be between 0 and 1")
+		}
+		*qf = append(*qf, q)
+	}
+	return nil
+}
+
+type lastScrape struct {
+	h  *native.Histogram
+	ts time.Time
+}
+
+// ReportIntervalQuantiles estimates the configured quantiles from the increase
+// of the histogram since its last scrape, which is what a dashboard typically
+// shows (rather than quantiles of all observations since the start of the
+// target). Nothing is reported for the first scrape of a histogram or if the
+// time stamp did not advance since the last scrape.
+func ReportIntervalQuantiles(key string, h *native.Histogram, ts time.Time, o io.Writer) {
+	last, ok := lastScrapes[key]
+	lastScrapes[key] = lastScrape{h: h, ts: ts}
+	if !ok || len(quantiles) == 0 {
+		return
+	}
+	interval := ts.Sub(last.ts)
+	rate, reset, err := native.Rate(last.h, h, interval)
+	if err != nil {
+		fmt.Fprintln(o, "- Skipping interval quantiles:", err)
+		return
+	}
+	if reset {
+		fmt.Fprintln(o, "- Counter reset detected since last scrape.")
+	}
+	fmt.Fprintf(o, "- Over the last %v: %.2f observations/s, schema %d, zero threshold %g\n", interval, rate.Count, rate.Schema, rate.ZeroThreshold)
+	for _, q := range quantiles {
+		fmt.Fprintf(o, "  %g-quantile → %g\n", q, rate.Quantile(q))
+	}
+}
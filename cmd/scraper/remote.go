@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/beorn7/histogram_experiments/block"
+	"github.com/beorn7/histogram_experiments/remote"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	remoteWriteURL     = flag.String("remote-write-url", "", "If set, send every scraped native histogram as a remote-write request to this URL (e.g. a local 'receiver').")
+	remoteWriteVersion = flag.Int("remote-write-version", remote.Version1, "Version of the remote-write protocol to use, 1 (for 1.0) or 2 (for 2.0).")
+	remoteExpectedURL  = flag.String("remote-write-expected-url", "", "If set, send the scraped histograms before each remote-write request to this URL (e.g. http://localhost:9201/expected of a local 'receiver'), so that the receiver can compare them with what it receives.")
+
+	remoteSamples  []remote.Sample     // Samples of the current scrape.
+	remoteExpected []*dto.MetricFamily // The scraped histograms the samples were created from.
+	remoteTotal    remote.Stats        // Sum of all requests sent so far.
+)
+
+// AddRemoteSample adds the native histogram of metric m in metric family mf to
+// the remote-write request sent by SendRemoteSamples, if enabled.
+func AddRemoteSample(mf *dto.MetricFamily, m *dto.Metric, ts time.Time) {
+	if *remoteWriteURL == "" {
+		return
+	}
+	remoteSamples = append(remoteSamples, remote.NewSample(block.Labels(mf.GetName(), m.GetLabel()), ts, m.GetHistogram()))
+	if *remoteExpectedURL != "" {
+		m = proto.Clone(m).(*dto.Metric)
+		m.TimestampMs = proto.Int64(ts.UnixMilli())
+		remoteExpected = append(remoteExpected, &dto.MetricFamily{
+			Name:   mf.Name,
+			Type:   mf.Type,
+			Metric: []*dto.Metric{m},
+		})
+	}
+}
+
+// SendRemoteSamples sends the samples added in the current scrape in a single
+// remote-write request and reports its size on the wire. If enabled, the
+// scraped histograms are sent to --remote-write-expected-url first.
+func SendRemoteSamples(o io.Writer) error {
+	if len(remoteSamples) == 0 {
+		return nil
+	}
+	defer func() { remoteSamples, remoteExpected = remoteSamples[:0], remoteExpected[:0] }()
+	if *remoteExpectedURL != "" {
+		if err := remote.SendExpected(http.DefaultClient, *remoteExpectedURL, remoteExpected); err != nil {
+			return fmt.Errorf("sending expected histograms: %w", err)
+		}
+	}
+	stats, err := remote.Send(http.DefaultClient, *remoteWriteURL, *remoteWriteVersion, remoteSamples)
+	if err != nil {
+		return err
+	}
+	remoteTotal.Samples += stats.Samples
+	remoteTotal.Compressed += stats.Compressed
+	remoteTotal.Uncompressed += stats.Uncompressed
+	fmt.Fprintf(
+		o, "### Remote write %d.0: %d histograms, %d bytes compressed (%d uncompressed), %.1f bytes per sample (%.1f in total so far)\n",
+		*remoteWriteVersion, stats.Samples, stats.Compressed, stats.Uncompressed, stats.BytesPerSample(), remoteTotal.BytesPerSample(),
+	)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/beorn7/histogram_experiments/block"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	tsdbDir = flag.String("tsdb-dir", "", "If set, append every scraped native histogram to a Prometheus TSDB. Upon exit (after a single scrape, or upon SIGINT/SIGTERM in continuous mode), a block is written into this directory and the actual chunk bytes per series are reported.")
+
+	tsdbWriter      *block.Writer
+	tsdbKeys        = map[string]string{} // Keys of storages, keyed by string representation of the series labels.
+	tsdbClassicKeys = map[string]string{} // Like tsdbKeys, but for the series of classic buckets.
+)
+
+// AppendToTSDB appends the native histogram h of metric m in metric family mf
+// to the TSDB, if enabled. If the histogram also has classic buckets, they are
+// appended, too, as float samples in the usual series per bucket plus _sum and
+// _count. The samples are only committed with CommitToTSDB.
+func AppendToTSDB(key string, mf *dto.MetricFamily, m *dto.Metric, ts time.Time) error {
+	if tsdbWriter == nil {
+		return nil
+	}
+	h := m.GetHistogram()
+	lset := block.Labels(mf.GetName(), m.GetLabel())
+	tsdbKeys[lset.String()] = key
+	if err := tsdbWriter.Append(lset, ts, h); err != nil {
+		return err
+	}
+	if len(h.GetBucket()) == 0 {
+		return nil
+	}
+
+	appendFloat := func(lset labels.Labels, v float64) error {
+		tsdbClassicKeys[lset.String()] = key
+		return tsdbWriter.AppendFloat(lset, ts, v)
+	}
+	bounds, cumCounts := classicBuckets(h)
+	bounds, cumCounts = append(bounds, math.Inf(1)), append(cumCounts, histogramCount(h))
+	for i, le := range bounds {
+		pairs := append(m.GetLabel(), &dto.LabelPair{
+			Name:  proto.String(model.BucketLabel),
+			Value: proto.String(strconv.FormatFloat(le, 'g', -1, 64)),
+		})
+		if err := appendFloat(block.Labels(mf.GetName()+"_bucket", pairs), cumCounts[i]); err != nil {
+			return err
+		}
+	}
+	if err := appendFloat(block.Labels(mf.GetName()+"_count", m.GetLabel()), histogramCount(h)); err != nil {
+		return err
+	}
+	return appendFloat(block.Labels(mf.GetName()+"_sum", m.GetLabel()), h.GetSampleSum())
+}
+
+// CommitToTSDB commits the samples appended in the current scrape.
+func CommitToTSDB() error {
+	if tsdbWriter == nil {
+		return nil
+	}
+	return tsdbWriter.Commit()
+}
+
+// FlushTSDB writes the block and reports the actual storage cost of each
+// native histogram series in it. If bit buckets are configured, the storage
+// size estimated from the ΔΔ(Δ) values of the buckets is reported alongside,
+// and so is the actual storage cost of the series of classic buckets (if
+// any).
+func FlushTSDB(o io.Writer) error {
+	defer tsdbWriter.Close()
+	dir, err := tsdbWriter.Flush()
+	if err != nil {
+		return err
+	}
+	stats, err := block.ReadStats(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(o, "### Written TSDB block:", dir)
+	// First sum up the series of classic buckets, by key.
+	classic, classicSeries := map[string]*block.SeriesStats{}, map[string]int{}
+	for _, s := range stats {
+		key, ok := tsdbClassicKeys[s.Labels.String()]
+		if !ok {
+			continue
+		}
+		c := classic[key]
+		if c == nil {
+			c = &block.SeriesStats{}
+			classic[key] = c
+		}
+		c.Chunks += s.Chunks
+		c.Samples += s.Samples
+		c.Bytes += s.Bytes
+		classicSeries[key]++
+	}
+	for _, s := range stats {
+		key, ok := tsdbKeys[s.Labels.String()]
+		if !ok {
+			continue
+		}
+		fmt.Fprintln(o, "- Series", s.Labels)
+		fmt.Fprintf(
+			o, "  Chunk bytes: %d in %d chunks for %d samples (%.1f bytes per sample)\n",
+			s.Bytes, s.Chunks, s.Samples, float64(s.Bytes)/float64(s.Samples),
+		)
+		if st := storages[key]; st != nil && len(bitBuckets) > 0 && bitBuckets[0] != 0 {
+			bits := ReportBitBucketStats(st, bitBuckets, ioutil.Discard)
+			fmt.Fprintf(
+				o, "  Estimated bytes for ΔΔ(Δ) bucket values only: %d (%.1f bytes per scrape)\n",
+				bits/8, float64(bits)/8/float64(st.n),
+			)
+		}
+		if c := classic[key]; c != nil {
+			n := classicSeries[key]
+			fmt.Fprintf(
+				o, "  Classic buckets: %d chunk bytes in %d chunks for %d samples in %d series (%.1f bytes per scrape)\n",
+				c.Bytes, c.Chunks, c.Samples, n, float64(c.Bytes)*float64(n)/float64(c.Samples),
+			)
+		}
+	}
+	return nil
+}
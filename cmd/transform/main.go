@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+)
+
+var (
+	output       = flag.String("output", "-", "dataset file to write, - for stdout")
+	format       = flag.String("format", "text", "format of the input datasets: text, csv, or jsonl (see the exposer), the output is always in the text format")
+	from         = flag.String("from", "", "only keep observations at or after this time, either an RFC3339 time stamp or a duration relative to the first observation, e.g. '+10m'")
+	to           = flag.String("to", "", "only keep observations before this time, same format as --from")
+	sampleRatio  = flag.Float64("sample", 1, "keep each observation with this probability, thinning the dataset")
+	seed         = flag.Int64("seed", 1, "seed of the random number generator used by --sample")
+	start        = flag.String("start", "", "if set, shift the time stamps so that the first kept observation is at this RFC3339 time stamp (overrides --shift)")
+	shift        = flag.Duration("shift", 0, "shift the time stamps by this duration")
+	timeScale    = flag.Float64("time-scale", 1, "scale the time between the first kept observation and each following one by this factor, e.g. 0.1 to compress the dataset to a tenth of its duration")
+	valueScale   = flag.Float64("value-scale", 1, "multiply each observed value by this factor")
+	datasetLabel = flag.String("dataset-label", "", "if set, add a label with this name and the base name of the input file as value to each observation, to tell the merged datasets apart")
+	mapping      = dataset.DefaultMapping
+)
+
+func init() {
+	flag.StringVar(&mapping.Timestamp, "timestamp-field", mapping.Timestamp, "name of the CSV column or JSON field with the time stamp")
+	flag.StringVar(&mapping.Value, "value-field", mapping.Value, "name of the CSV column or JSON field with the observed value")
+	flag.StringVar(&mapping.Weight, "weight-field", mapping.Weight, "name of the CSV column or JSON field with the weight of the observation")
+	flag.Var((*stringsFlag)(&mapping.Labels), "label-fields", "comma-separated list of CSV columns or JSON fields to keep as labels")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] DATASET...\n\nMerges the datasets into one chronologically ordered dataset and transforms it as configured.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(value string) error {
+	*sf = strings.Split(value, ",")
+	return nil
+}
+
+// input is one of the merged datasets, with its next observation.
+type input struct {
+	name       string
+	src        dataset.Source
+	next       dataset.Observation
+	done       bool
+	outOfOrder int
+}
+
+// advance reads the next observation of in.
+func (in *input) advance() {
+	prev := in.next.Timestamp
+	o, err := in.src.Read()
+	if err == io.EOF {
+		in.done = true
+		return
+	}
+	if err != nil {
+		log.Fatalln("Could not read dataset", in.name+":", err)
+	}
+	if o.Timestamp.Before(prev) {
+		in.outOfOrder++
+	}
+	if *datasetLabel != "" {
+		if o.Labels == nil {
+			o.Labels = map[string]string{}
+		}
+		o.Labels[*datasetLabel] = in.name
+	}
+	in.next = o
+}
+
+// merge returns the observation with the earliest time stamp of all inputs,
+// or false if all inputs are exhausted. Each input is expected to be ordered
+// chronologically already.
+func merge(inputs []*input) (dataset.Observation, bool) {
+	var earliest *input
+	for _, in := range inputs {
+		if !in.done && (earliest == nil || in.next.Timestamp.Before(earliest.next.Timestamp)) {
+			earliest = in
+		}
+	}
+	if earliest == nil {
+		return dataset.Observation{}, false
+	}
+	o := earliest.next
+	earliest.advance()
+	return o, true
+}
+
+// parseBound parses --from or --to, relative to first if it starts with '+'.
+func parseBound(s string, first time.Time) (time.Time, error) {
+	if strings.HasPrefix(s, "+") {
+		d, err := time.ParseDuration(s[1:])
+		return first.Add(d), err
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// thin returns the number of the weight units of an observation kept with
+// probability --sample each.
+func thin(r *rand.Rand, weight uint64) uint64 {
+	if *sampleRatio >= 1 {
+		return weight
+	}
+	return binomial(r, weight, *sampleRatio)
+}
+
+// binomial draws from the binomial distribution with n trials of probability
+// p each. Only small n are drawn trial by trial. Otherwise, the Poisson
+// approximation is used if successes or failures are rare, and the normal
+// approximation if not, so that even the largest weights don't take long.
+func binomial(r *rand.Rand, n uint64, p float64) uint64 {
+	const (
+		maxTrials = 64 // Up to which trials are drawn one by one.
+		maxRare   = 30 // Up to which mean successes or failures count as rare.
+	)
+	switch {
+	case p <= 0:
+		return 0
+	case p >= 1:
+		return n
+	case n <= maxTrials:
+		var k uint64
+		for i := uint64(0); i < n; i++ {
+			if r.Float64() < p {
+				k++
+			}
+		}
+		return k
+	case float64(n)*p <= maxRare:
+		return min(poisson(r, float64(n)*p), n)
+	case float64(n)*(1-p) <= maxRare:
+		return n - min(poisson(r, float64(n)*(1-p)), n)
+	}
+	mean := float64(n) * p
+	k := math.Round(mean + r.NormFloat64()*math.Sqrt(mean*(1-p)))
+	switch {
+	case k <= 0:
+		return 0
+	case k >= float64(n): // Also avoids overflowing uint64 for huge n.
+		return n
+	}
+	return uint64(k)
+}
+
+// poisson draws from the Poisson distribution with the given (small) mean,
+// using Knuth's algorithm.
+func poisson(r *rand.Rand, mean float64) uint64 {
+	var (
+		limit = math.Exp(-mean)
+		prod  = r.Float64()
+		k     uint64
+	)
+	for prod > limit {
+		k++
+		prod *= r.Float64()
+	}
+	return k
+}
+
+// within returns true if ts is at or after lower (if set) and before upper (if
+// set).
+func within(ts, lower, upper time.Time) bool {
+	return !ts.Before(lower) && (upper.IsZero() || ts.Before(upper))
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *sampleRatio <= 0 || *sampleRatio > 1 {
+		log.Fatalln("--sample must be greater than 0 and at most 1, provided value:", *sampleRatio)
+	}
+	if *timeScale <= 0 {
+		log.Fatalln("--time-scale must be positive, provided value:", *timeScale)
+	}
+	var startTime time.Time
+	if *start != "" {
+		var err error
+		if startTime, err = time.Parse(time.RFC3339Nano, *start); err != nil {
+			log.Fatalln("Invalid --start:", err)
+		}
+	}
+
+	var inputs []*input
+	for _, name := range flag.Args() {
+		f, err := dataset.Open(name, false)
+		if err != nil {
+			log.Fatalln("Could not open dataset file:", err)
+		}
+		defer f.Close()
+		src, err := dataset.NewSource(f, *format, mapping)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		in := &input{name: dataset.Name(name), src: src}
+		in.advance()
+		inputs = append(inputs, in)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln("Could not create dataset file:", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	var (
+		r                   = rand.New(rand.NewSource(*seed))
+		lower, upper        time.Time
+		first, firstKept    time.Time
+		read, written, kept uint64
+	)
+	for {
+		o, ok := merge(inputs)
+		if !ok {
+			break
+		}
+		read += o.Weight
+		if first.IsZero() {
+			first = o.Timestamp
+			var err error
+			if *from != "" {
+				if lower, err = parseBound(*from, first); err != nil {
+					log.Fatalln("Invalid --from:", err)
+				}
+			}
+			if *to != "" {
+				if upper, err = parseBound(*to, first); err != nil {
+					log.Fatalln("Invalid --to:", err)
+				}
+			}
+		}
+		if !within(o.Timestamp, lower, upper) {
+			continue
+		}
+		weight := o.Weight
+		if o.Weight = thin(r, weight); o.Weight == 0 && weight > 0 {
+			continue
+		}
+		if firstKept.IsZero() {
+			firstKept = o.Timestamp
+			if !startTime.IsZero() {
+				*shift = startTime.Sub(firstKept)
+			}
+		}
+		offset := time.Duration(float64(o.Timestamp.Sub(firstKept)) * *timeScale)
+		o.Timestamp = firstKept.Add(offset + *shift)
+		o.Value *= *valueScale
+		if _, err := fmt.Fprintln(w, o); err != nil {
+			log.Fatalln("Could not write dataset:", err)
+		}
+		written++
+		kept += o.Weight
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalln("Could not write dataset:", err)
+	}
+	log.Printf("Read %d observations, wrote %d observations in %d lines.", read, kept, written)
+	for _, in := range inputs {
+		if in.outOfOrder > 0 {
+			log.Println("Warning:", in.outOfOrder, "observations of", in.name, "are out of chronological order, the result is not strictly ordered either.")
+		}
+	}
+}
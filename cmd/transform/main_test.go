@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+)
+
+func newInput(name, content string) *input {
+	in := &input{name: name, src: dataset.NewReader(strings.NewReader(content))}
+	in.advance()
+	return in
+}
+
+func TestMerge(t *testing.T) {
+	inputs := []*input{
+		newInput("a", "2019-09-18T19:19:01Z 1\n2019-09-18T19:19:04Z 4\n2019-09-18T19:19:05Z 5\n"),
+		newInput("b", "2019-09-18T19:19:02Z 2\n2019-09-18T19:19:03Z 3\n2019-09-18T19:19:06Z 6\n"),
+		newInput("c", ""),
+	}
+	var got []float64
+	for {
+		o, ok := merge(inputs)
+		if !ok {
+			break
+		}
+		got = append(got, o.Value)
+	}
+	if want := []float64{1, 2, 3, 4, 5, 6}; !slices.Equal(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	first := time.Date(2019, 9, 18, 19, 19, 0, 0, time.UTC)
+	lower, err := parseBound("+10s", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper, err := parseBound("2019-09-18T19:19:20Z", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseBound("+10", first); err == nil {
+		t.Error("expected error for a duration without unit")
+	}
+
+	scenarios := []struct {
+		offset       time.Duration
+		lower, upper time.Time
+		want         bool
+	}{
+		{9 * time.Second, lower, upper, false},
+		{10 * time.Second, lower, upper, true}, // --from is inclusive.
+		{19 * time.Second, lower, upper, true},
+		{20 * time.Second, lower, upper, false}, // --to is exclusive.
+		{0, time.Time{}, upper, true},
+		{time.Hour, lower, time.Time{}, true},
+	}
+	for _, s := range scenarios {
+		if got := within(first.Add(s.offset), s.lower, s.upper); got != s.want {
+			t.Errorf("%s after first observation: got %t, want %t", s.offset, got, s.want)
+		}
+	}
+}
+
+func TestBinomial(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, s := range []struct {
+		n uint64
+		p float64
+	}{
+		{10, 0.5},             // Trial by trial.
+		{1000, 0.01},          // Rare successes.
+		{1000, 0.99},          // Rare failures.
+		{1e6, 0.3},            // Normal approximation.
+		{math.MaxUint64, 0.5}, // Must not take forever.
+	} {
+		const draws = 200
+		var sum float64
+		for i := 0; i < draws; i++ {
+			k := binomial(r, s.n, s.p)
+			if k > s.n {
+				t.Fatalf("n=%d p=%g: drew %d", s.n, s.p, k)
+			}
+			sum += float64(k)
+		}
+		mean, want := sum/draws, float64(s.n)*s.p
+		// Five standard errors of the mean.
+		if tolerance := 5 * math.Sqrt(want*(1-s.p)/draws); math.Abs(mean-want) > tolerance+1e-9*want {
+			t.Errorf("n=%d p=%g: mean of %d draws is %g, want %g±%g", s.n, s.p, draws, mean, want, tolerance)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package dataset reads the datasets in the datasets directory of this
+// repository. Each line of a dataset consists of an RFC3339Nano time stamp and
+// the observed value, separated by a single space. The value is either a Go
+// duration string (which is converted to seconds) or a float. Optionally, the
+// value may be followed by a weight (the number of times the value has been
+// observed) and by any number of labels in the form name=value, again
+// separated by single spaces.
+//
+// Datasets exported from elsewhere can be read as CSV or JSON Lines, see
+// NewCSVReader and NewJSONReader.
+package dataset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Observation is a single line of a dataset.
+type Observation struct {
+	Timestamp time.Time
+	Value     float64
+	// Weight is the number of times Value has been observed, 1 if the
+	// dataset doesn't specify it.
+	Weight uint64
+	// Labels is nil if the dataset doesn't specify any labels.
+	Labels map[string]string
+}
+
+// String formats the Observation as a line of a dataset in the text format
+// (without the trailing newline). The weight is omitted if it is 1, labels are
+// sorted by name.
+func (o Observation) String() string {
+	var sb strings.Builder
+	sb.WriteString(o.Timestamp.Format(time.RFC3339Nano))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.FormatFloat(o.Value, 'g', -1, 64))
+	if o.Weight != 1 {
+		sb.WriteByte(' ')
+		sb.WriteString(strconv.FormatUint(o.Weight, 10))
+	}
+	names := make([]string, 0, len(o.Labels))
+	for name := range o.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteByte(' ')
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(o.Labels[name])
+	}
+	return sb.String()
+}
+
+// Source is implemented by all readers of this package.
+type Source interface {
+	// Read returns the next Observation, see Reader.Read.
+	Read() (Observation, error)
+	// Line returns the number of the line read last, starting with 1.
+	Line() int
+}
+
+// ParseError is returned by Reader.Read for a line that could not be
+// parsed. Reading may continue after a ParseError.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads Observations from a dataset.
+type Reader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{s: bufio.NewScanner(r)}
+}
+
+// Read returns the next Observation. At the end of the input, it returns
+// io.EOF. If a line cannot be parsed, a *ParseError is returned. Any other
+// error is an error reading the input, after which reading cannot continue.
+func (r *Reader) Read() (Observation, error) {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return Observation{}, err
+		}
+		return Observation{}, io.EOF
+	}
+	r.line++
+	o, err := ParseLine(r.s.Text())
+	if err != nil {
+		return Observation{}, &ParseError{Line: r.line, Err: err}
+	}
+	return o, nil
+}
+
+// Line returns the number of the line read last, starting with 1.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// ParseLine parses a single line of a dataset.
+func ParseLine(line string) (Observation, error) {
+	ss := strings.Split(line, " ")
+	if len(ss) < 2 {
+		return Observation{}, fmt.Errorf("unexpected number of tokens: %d", len(ss))
+	}
+	ts, err := time.Parse(time.RFC3339Nano, ss[0])
+	if err != nil {
+		return Observation{}, fmt.Errorf("could not parse time stamp: %w", err)
+	}
+	v, err := ParseValue(ss[1])
+	if err != nil {
+		return Observation{}, err
+	}
+	o := Observation{Timestamp: ts, Value: v, Weight: 1}
+	rest := ss[2:]
+	if len(rest) > 0 && !strings.Contains(rest[0], "=") {
+		if o.Weight, err = ParseWeight(rest[0]); err != nil {
+			return Observation{}, err
+		}
+		rest = rest[1:]
+	}
+	for _, l := range rest {
+		name, value, ok := strings.Cut(l, "=")
+		if !ok || name == "" {
+			return Observation{}, fmt.Errorf("could not parse label %q", l)
+		}
+		if o.Labels == nil {
+			o.Labels = map[string]string{}
+		}
+		o.Labels[name] = value
+	}
+	return o, nil
+}
+
+// decimalSecondsRE matches seconds in plain decimal notation, which are parsed
+// exactly (a float64 only has sub-microsecond precision for current times).
+var decimalSecondsRE = regexp.MustCompile(`^(-?\d+)(?:\.(\d+))?$`)
+
+// ParseTimestamp parses a time stamp, which is either in RFC3339Nano format or
+// a (possibly fractional) number of seconds since the Unix epoch.
+func ParseTimestamp(s string) (time.Time, error) {
+	if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return ts, nil
+	}
+	if m := decimalSecondsRE.FindStringSubmatch(s); m != nil {
+		whole, err := strconv.ParseInt(m[1], 10, 64)
+		if err == nil {
+			frac := (m[2] + "000000000")[:9] // Truncated to nanoseconds.
+			nanos, _ := strconv.ParseInt(frac, 10, 64)
+			if strings.HasPrefix(m[1], "-") {
+				nanos = -nanos
+			}
+			return time.Unix(whole, nanos), nil
+		}
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return time.Time{}, fmt.Errorf("could not parse time stamp %q", s)
+	}
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*1e9)), nil
+}
+
+// ParseWeight parses the weight of an observation, which has to be a
+// non-negative integer.
+func ParseWeight(s string) (uint64, error) {
+	w, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse weight: %w", err)
+	}
+	return w, nil
+}
+
+// ParseValue parses an observed value, which is either a duration (converted
+// to seconds) or a float.
+func ParseValue(s string) (float64, error) {
+	if duration, err := time.ParseDuration(s); err == nil {
+		return duration.Seconds(), nil
+	}
+	// It doesn't appear to be a duration. Try raw number.
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse value: %w", err)
+	}
+	return v, nil
+}
@@ -0,0 +1,273 @@
+package dataset
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAll reads all Observations from s, stopping at the first error other
+// than a *ParseError, and returns them together with the lines of the parse
+// errors.
+func readAll(t *testing.T, s Source) (obs []Observation, errLines []int) {
+	t.Helper()
+	for {
+		o, err := s.Read()
+		if err == io.EOF {
+			return obs, errLines
+		}
+		var pe *ParseError
+		if errors.As(err, &pe) {
+			errLines = append(errLines, pe.Line)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		obs = append(obs, o)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	ts := time.Date(2019, 9, 18, 19, 19, 8, 155627000, time.FixedZone("", 2*3600))
+	scenarios := []struct {
+		line    string
+		want    Observation
+		wantErr bool
+	}{
+		{"2019-09-18T19:19:08.155627+02:00 -1.5", Observation{Timestamp: ts, Value: -1.5, Weight: 1}, false},
+		{"2019-09-18T19:19:08.155627+02:00 150ms 3", Observation{Timestamp: ts, Value: 0.15, Weight: 3}, false},
+		{
+			"2019-09-18T19:19:08.155627+02:00 2 method=GET status=200",
+			Observation{Timestamp: ts, Value: 2, Weight: 1, Labels: map[string]string{"method": "GET", "status": "200"}},
+			false,
+		},
+		{
+			"2019-09-18T19:19:08.155627+02:00 2 0 method=",
+			Observation{Timestamp: ts, Value: 2, Weight: 0, Labels: map[string]string{"method": ""}},
+			false,
+		},
+		{"2019-09-18T19:19:08.155627+02:00", Observation{}, true},
+		{"2019-09-18T19:19:08.155627+02:00 2 -1", Observation{}, true},
+		{"2019-09-18T19:19:08.155627+02:00 2 =GET", Observation{}, true},
+		{"2019-09-18T19:19:08.155627+02:00 2 method=GET 3", Observation{}, true},
+	}
+	for _, s := range scenarios {
+		got, err := ParseLine(s.line)
+		if s.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got %+v", s.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", s.line, err)
+			continue
+		}
+		if !got.Timestamp.Equal(s.want.Timestamp) {
+			t.Errorf("%q: got time stamp %v, want %v", s.line, got.Timestamp, s.want.Timestamp)
+		}
+		got.Timestamp = s.want.Timestamp
+		if !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%q: got %+v, want %+v", s.line, got, s.want)
+		}
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	in := `latency,ts,n,method
+0.5,1568827148.5,2,GET
+"1s",2019-09-18T19:19:08Z,,POST
+oops,1568827148,1,GET
+0.25,1568827149
+`
+	m := Mapping{Timestamp: "ts", Value: "latency", Weight: "n", Labels: []string{"method"}}
+	obs, errLines := readAll(t, NewCSVReader(strings.NewReader(in), m))
+	if !reflect.DeepEqual(errLines, []int{4}) {
+		t.Errorf("got parse errors in lines %v, want [4]", errLines)
+	}
+	if len(obs) != 3 {
+		t.Fatalf("got %d observations, want 3", len(obs))
+	}
+	if want := time.Unix(1568827148, 5e8); !obs[0].Timestamp.Equal(want) {
+		t.Errorf("got time stamp %v, want %v", obs[0].Timestamp, want)
+	}
+	if obs[0].Value != 0.5 || obs[0].Weight != 2 || obs[0].Labels["method"] != "GET" {
+		t.Errorf("got %+v", obs[0])
+	}
+	if obs[1].Value != 1 || obs[1].Weight != 1 || obs[1].Labels["method"] != "POST" {
+		t.Errorf("got %+v", obs[1])
+	}
+	if obs[2].Value != 0.25 || obs[2].Labels != nil {
+		t.Errorf("got %+v", obs[2])
+	}
+
+	_, err := NewCSVReader(strings.NewReader("value,time\n1,2\n"), DefaultMapping).Read()
+	if err == nil || errors.As(err, new(*ParseError)) {
+		t.Errorf("expected a fatal error for a missing column, got %v", err)
+	}
+}
+
+func TestJSONReader(t *testing.T) {
+	in := `{"timestamp": "2019-09-18T19:19:08Z", "value": 1.5, "path": "/api"}
+
+{"timestamp": 1568827148, "value": "20ms", "weight": 4}
+{"timestamp": 1568827148, "value":
+{"value": 1}
+`
+	m := DefaultMapping
+	m.Weight = "weight"
+	m.Labels = []string{"path"}
+	r := NewJSONReader(strings.NewReader(in), m)
+	obs, errLines := readAll(t, r)
+	if !reflect.DeepEqual(errLines, []int{4, 5}) {
+		t.Errorf("got parse errors in lines %v, want [4 5]", errLines)
+	}
+	if len(obs) != 2 {
+		t.Fatalf("got %d observations, want 2", len(obs))
+	}
+	if obs[0].Value != 1.5 || obs[0].Weight != 1 || obs[0].Labels["path"] != "/api" {
+		t.Errorf("got %+v", obs[0])
+	}
+	if obs[1].Value != 0.02 || obs[1].Weight != 4 || obs[1].Labels != nil {
+		t.Errorf("got %+v", obs[1])
+	}
+}
+
+func TestObservationString(t *testing.T) {
+	for _, line := range []string{
+		"2019-09-18T19:19:08.155627+02:00 -1.5",
+		"2019-09-18T19:19:08Z 0.15 3",
+		"2019-09-18T19:19:08Z 2 0 method=GET status=200",
+		"2019-09-18T19:19:08Z 1e-09 path=/",
+	} {
+		o, err := ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := o.String(); got != line {
+			t.Errorf("got %q, want %q", got, line)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	const content = "2019-09-18T19:19:08Z 1\n2019-09-18T19:19:09Z 2\n"
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, []byte(content), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	compressed := filepath.Join(dir, "compressed.gz")
+	f, err := os.Create(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(f)
+	gw.Write([]byte(content))
+	gw.Close()
+	f.Close()
+
+	for _, name := range []string{plain, compressed} {
+		rc, err := Open(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%s: got %q, want %q", name, got, content)
+		}
+	}
+	if got, want := Name(compressed), "compressed"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+}
+
+func TestOpenFollow(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first line\n")
+	rc, err := Open(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	lines := make(chan string)
+	go func() {
+		br := bufio.NewReader(rc)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("got line %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for line %q", want)
+		}
+	}
+
+	expect("first line\n")
+	// Rotated like logrotate does it, then truncated.
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write("rotated\n")
+	expect("rotated\n")
+	write("cut\n")
+	expect("cut\n")
+}
+
+func TestParseTimestamp(t *testing.T) {
+	scenarios := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2019-09-18T19:19:08.155627+02:00", time.Date(2019, 9, 18, 17, 19, 8, 155627000, time.UTC)},
+		{"1568827148", time.Unix(1568827148, 0)},
+		{"1568827148.123456789", time.Unix(1568827148, 123456789)},
+		{"1568827148.5", time.Unix(1568827148, 5e8)},
+		{"-1.5", time.Unix(-2, 5e8)},
+		{"1.568827148e9", time.Unix(1568827148, 0)},
+	}
+	for _, s := range scenarios {
+		got, err := ParseTimestamp(s.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", s.in, err)
+			continue
+		}
+		if !got.Equal(s.want) {
+			t.Errorf("%q: got %v, want %v", s.in, got, s.want)
+		}
+	}
+	for _, in := range []string{"", "yesterday", "NaN", "1.2.3"} {
+		if _, err := ParseTimestamp(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package dataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Mapping maps the fields of a CSV or JSON Lines dataset to the parts of an
+// Observation.
+type Mapping struct {
+	// Timestamp and Value name the fields with the time stamp (see
+	// ParseTimestamp) and the observed value (see ParseValue). Both are
+	// required.
+	Timestamp, Value string
+	// Weight optionally names the field with the weight (see
+	// ParseWeight). A missing or empty weight is 1.
+	Weight string
+	// Labels names the fields to use as labels, with the field name as the
+	// label name. Fields missing in a line are not added to the labels.
+	Labels []string
+}
+
+// DefaultMapping maps fields named after the parts of an Observation.
+var DefaultMapping = Mapping{Timestamp: "timestamp", Value: "value"}
+
+// observation builds an Observation from the fields of a record, as returned
+// by get.
+func (m Mapping) observation(get func(field string) (string, bool)) (Observation, error) {
+	s, ok := get(m.Timestamp)
+	if !ok {
+		return Observation{}, fmt.Errorf("missing time stamp field %q", m.Timestamp)
+	}
+	ts, err := ParseTimestamp(s)
+	if err != nil {
+		return Observation{}, err
+	}
+	if s, ok = get(m.Value); !ok {
+		return Observation{}, fmt.Errorf("missing value field %q", m.Value)
+	}
+	v, err := ParseValue(s)
+	if err != nil {
+		return Observation{}, err
+	}
+	o := Observation{Timestamp: ts, Value: v, Weight: 1}
+	if m.Weight != "" {
+		if s, ok = get(m.Weight); ok && s != "" {
+			if o.Weight, err = ParseWeight(s); err != nil {
+				return Observation{}, err
+			}
+		}
+	}
+	for _, l := range m.Labels {
+		if s, ok = get(l); ok {
+			if o.Labels == nil {
+				o.Labels = map[string]string{}
+			}
+			o.Labels[l] = s
+		}
+	}
+	return o, nil
+}
+
+// CSVReader reads Observations from a CSV dataset. The first record is a
+// header naming the columns, which are mapped to the parts of the
+// Observation by a Mapping.
+type CSVReader struct {
+	r       *csv.Reader
+	m       Mapping
+	columns map[string]int
+	line    int
+	err     error // Sticky error from reading the header.
+}
+
+// NewCSVReader returns a CSVReader reading from r, using the Mapping m.
+func NewCSVReader(r io.Reader, m Mapping) *CSVReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	return &CSVReader{r: cr, m: m}
+}
+
+// Read returns the next Observation, see Reader.Read. A missing or incomplete
+// header is an error after which reading cannot continue.
+func (r *CSVReader) Read() (Observation, error) {
+	if r.err != nil {
+		return Observation{}, r.err
+	}
+	if r.columns == nil {
+		if r.err = r.readHeader(); r.err != nil {
+			return Observation{}, r.err
+		}
+	}
+	record, err := r.r.Read()
+	if err != nil {
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			r.line = pe.Line
+			return Observation{}, &ParseError{Line: pe.Line, Err: pe.Err}
+		}
+		return Observation{}, err
+	}
+	r.line, _ = r.r.FieldPos(0)
+	o, err := r.m.observation(func(field string) (string, bool) {
+		i, ok := r.columns[field]
+		if !ok || i >= len(record) {
+			return "", false
+		}
+		return record[i], true
+	})
+	if err != nil {
+		return Observation{}, &ParseError{Line: r.line, Err: err}
+	}
+	return o, nil
+}
+
+func (r *CSVReader) readHeader() error {
+	header, err := r.r.Read()
+	if err != nil {
+		return err
+	}
+	r.line = 1
+	r.columns = map[string]int{}
+	for i, name := range header {
+		r.columns[name] = i
+	}
+	for _, name := range []string{r.m.Timestamp, r.m.Value} {
+		if _, ok := r.columns[name]; !ok {
+			return fmt.Errorf("CSV header has no column %q", name)
+		}
+	}
+	return nil
+}
+
+// Line returns the number of the line read last, starting with 1 (for the
+// header).
+func (r *CSVReader) Line() int {
+	return r.line
+}
+
+// JSONReader reads Observations from a JSON Lines dataset, i.e. one JSON
+// object per line. The fields of each object are mapped to the parts of the
+// Observation by a Mapping. Field values may be strings or numbers.
+type JSONReader struct {
+	s    *bufio.Scanner
+	m    Mapping
+	line int
+}
+
+// NewJSONReader returns a JSONReader reading from r, using the Mapping m.
+func NewJSONReader(r io.Reader, m Mapping) *JSONReader {
+	return &JSONReader{s: bufio.NewScanner(r), m: m}
+}
+
+// Read returns the next Observation, see Reader.Read. Empty lines are
+// skipped.
+func (r *JSONReader) Read() (Observation, error) {
+	for {
+		if !r.s.Scan() {
+			if err := r.s.Err(); err != nil {
+				return Observation{}, err
+			}
+			return Observation{}, io.EOF
+		}
+		r.line++
+		if len(bytes.TrimSpace(r.s.Bytes())) > 0 {
+			break
+		}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(r.s.Bytes(), &fields); err != nil {
+		return Observation{}, &ParseError{Line: r.line, Err: err}
+	}
+	o, err := r.m.observation(func(field string) (string, bool) {
+		raw, ok := fields[field]
+		if !ok || string(raw) == "null" {
+			return "", false
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s, true
+		}
+		// Not a string, so use the number (or whatever it is) verbatim.
+		return string(raw), true
+	})
+	if err != nil {
+		return Observation{}, &ParseError{Line: r.line, Err: err}
+	}
+	return o, nil
+}
+
+// Line returns the number of the line read last, starting with 1.
+func (r *JSONReader) Line() int {
+	return r.line
+}
+
+// Formats lists the formats supported by NewSource.
+var Formats = []string{"text", "csv", "jsonl"}
+
+// NewSource returns a Source reading from r in the given format, which is one
+// of Formats. The Mapping is ignored for the text format.
+func NewSource(r io.Reader, format string, m Mapping) (Source, error) {
+	switch format {
+	case "text":
+		return NewReader(r), nil
+	case "csv":
+		return NewCSVReader(r, m), nil
+	case "jsonl":
+		return NewJSONReader(r, m), nil
+	}
+	return nil, fmt.Errorf("unknown dataset format %q, must be one of %s", format, strings.Join(Formats, ", "))
+}
@@ -0,0 +1,138 @@
+package dataset
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// followInterval is how often a followed file is checked for new data.
+const followInterval = 250 * time.Millisecond
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Open opens the named dataset file for reading, with "-" meaning stdin. Gzip
+// and bzip2 compressed files are decompressed transparently (detected by their
+// content, not their name). If follow is true, reaching the end of the file
+// doesn't end reading. Instead, reading blocks until the file grows, like
+// tail -F does: If the file is truncated, reading starts over at its
+// beginning, and if it is replaced by a new file under the same name (as
+// logrotate does), the new file is read from its beginning.
+func Open(name string, follow bool) (io.ReadCloser, error) {
+	var f *os.File
+	if name == "-" {
+		f = os.Stdin
+	} else {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		r io.Reader = f
+		c io.Closer = f
+	)
+	if follow && f != os.Stdin {
+		fr := &followReader{name: name, f: f}
+		r, c = fr, fr
+	}
+	br := bufio.NewReader(r)
+	// Peek blocks for a followed file until enough data has arrived, or
+	// returns an error for a file that is too short to be compressed.
+	magic, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return readCloser{gr, c}, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return readCloser{bzip2.NewReader(br), c}, nil
+	}
+	return readCloser{br, c}, nil
+}
+
+// Name returns a short name for the named dataset file, i.e. its base name
+// without a compression extension, or "stdin" for "-".
+func Name(name string) string {
+	if name == "-" {
+		return "stdin"
+	}
+	base := filepath.Base(name)
+	for _, ext := range []string{".gz", ".bz2"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	return base
+}
+
+// followReader waits for more data instead of returning io.EOF. At the end of
+// the file, it checks if the file has been truncated or replaced.
+type followReader struct {
+	name string
+	f    *os.File
+}
+
+func (fr *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := fr.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if err := fr.reopen(); err != nil {
+			return 0, err
+		}
+		time.Sleep(followInterval)
+	}
+}
+
+// reopen opens the file named fr.name again if it is not the file read so far
+// anymore, or seeks to the beginning of the file if it has been truncated to
+// less than has been read. A file that is missing (e.g. in the middle of a
+// rotation) is waited for.
+func (fr *followReader) reopen() error {
+	fi, err := os.Stat(fr.name)
+	if err != nil {
+		return nil
+	}
+	cur, err := fr.f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, cur) {
+		f, err := os.Open(fr.name)
+		if err != nil {
+			return nil
+		}
+		fr.f.Close()
+		fr.f = f
+		return nil
+	}
+	pos, err := fr.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if fi.Size() < pos {
+		_, err = fr.f.Seek(0, io.SeekStart)
+	}
+	return err
+}
+
+func (fr *followReader) Close() error {
+	return fr.f.Close()
+}
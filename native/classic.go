@@ -0,0 +1,215 @@
+package native
+
+import (
+	"math"
+	"sort"
+)
+
+// bucketKind tells apart the kinds of buckets, which differ in the
+// inclusiveness of their bounds: Positive buckets are upper-inclusive,
+// negative buckets are lower-inclusive, and the zero bucket is inclusive on
+// both ends.
+type bucketKind int
+
+const (
+	negativeBucket bucketKind = iota
+	zeroBucket
+	positiveBucket
+)
+
+// eachBucket calls f for each bucket of h (in no particular order), including
+// the zero bucket, which is reported as ranging from -ZeroThreshold to
+// +ZeroThreshold. The buckets closest to zero are clipped to the zero
+// threshold.
+func (h *Histogram) eachBucket(f func(lower, upper, count float64, kind bucketKind)) {
+	for idx, count := range h.Negative {
+		f(-UpperBound(idx, h.Schema), math.Min(-UpperBound(idx-1, h.Schema), -h.ZeroThreshold), count, negativeBucket)
+	}
+	f(-h.ZeroThreshold, h.ZeroThreshold, h.ZeroCount, zeroBucket)
+	for idx, count := range h.Positive {
+		f(math.Max(UpperBound(idx-1, h.Schema), h.ZeroThreshold), UpperBound(idx, h.Schema), count, positiveBucket)
+	}
+}
+
+// CumulativeCountBounds returns the range the cumulative count of a classic
+// bucket with upper bound le must be in, given the Histogram. Observations in
+// buckets entirely below or at le are certainly counted, observations in the
+// bucket straddling le (if any) might or might not be counted. Observations
+// not in any bucket (i.e. NaN observations, which only count towards Count)
+// are ignored.
+func (h *Histogram) CumulativeCountBounds(le float64) (lo, hi float64) {
+	h.eachBucket(func(lower, upper, count float64, kind bucketKind) {
+		switch {
+		case upper <= le:
+			lo += count
+			hi += count
+		case lower < le || kind != positiveBucket && lower == le:
+			hi += count
+		}
+	})
+	return lo, hi
+}
+
+// CumulativeCount estimates the cumulative count of a classic bucket with
+// upper bound le, given the Histogram. Like Quantile, it assumes a uniform
+// distribution of observations within each bucket, and the zero bucket is
+// assumed to start at 0 if there are no negative buckets.
+func (h *Histogram) CumulativeCount(le float64) float64 {
+	var (
+		cum         float64
+		hasNegative = len(SortedIndices(h.Negative)) > 0
+	)
+	h.eachBucket(func(lower, upper, count float64, kind bucketKind) {
+		if kind == zeroBucket && !hasNegative {
+			lower = 0
+		}
+		switch {
+		case upper <= le:
+			cum += count
+		case lower < le:
+			cum += count * (le - lower) / (upper - lower)
+		}
+	})
+	return cum
+}
+
+// ToClassic projects the Histogram onto classic buckets with the given upper
+// bounds (which must be sorted), returning the estimated cumulative count for
+// each of them (see CumulativeCount). The count of the implicit +Inf bucket is
+// simply the Count of the Histogram.
+func (h *Histogram) ToClassic(bounds []float64) []float64 {
+	counts := make([]float64, len(bounds))
+	for i, le := range bounds {
+		counts[i] = h.CumulativeCount(le)
+	}
+	return counts
+}
+
+// NearestSchema returns the schema whose bucket growth factor is closest to
+// the typical (median) growth factor between consecutive positive classic
+// upper bounds, i.e. the native histogram schema with a resolution most
+// similar to the given classic buckets. If there are fewer than two positive
+// bounds, schema 0 is returned.
+func NearestSchema(bounds []float64) int32 {
+	var log2Factors []float64
+	prev := 0.0
+	for _, b := range bounds {
+		if b <= 0 || math.IsInf(b, 1) {
+			continue
+		}
+		if prev > 0 {
+			log2Factors = append(log2Factors, math.Log2(b/prev))
+		}
+		prev = b
+	}
+	if len(log2Factors) == 0 {
+		return 0
+	}
+	sort.Float64s(log2Factors)
+	median := log2Factors[len(log2Factors)/2]
+	// The log2 of the growth factor of schema s is 2^-s.
+	schema := int32(math.Round(-math.Log2(median)))
+	switch {
+	case schema < MinSchema:
+		return MinSchema
+	case schema > MaxSchema:
+		return MaxSchema
+	}
+	return schema
+}
+
+// FromClassic maps a classic histogram, given by the sorted upper bounds of
+// its buckets (excluding +Inf) and their cumulative counts, onto a float
+// native histogram with the given schema. The count of each classic bucket is
+// distributed over the native buckets it overlaps with, assuming a uniform
+// distribution within the classic bucket. The lowest classic bucket is assumed
+// to start at 0 if its upper bound is positive (like histogram_quantile in
+// PromQL does), otherwise its observations are put into the native bucket
+// containing its upper bound. Observations in the +Inf bucket are put into
+// the native bucket just above the highest upper bound. The zero threshold is
+// the smallest absolute value of the non-zero upper bounds, so that a lowest
+// classic bucket starting at 0 ends up in the zero bucket completely.
+func FromClassic(bounds, cumCounts []float64, count, sum float64, schema int32) *Histogram {
+	threshold := math.Inf(1)
+	for _, b := range bounds {
+		if b != 0 && math.Abs(b) < threshold {
+			threshold = math.Abs(b)
+		}
+	}
+	if math.IsInf(threshold, 1) {
+		threshold = 0
+	}
+	h := New(schema, threshold)
+	h.IsFloat = true
+	h.Count, h.Sum = count, sum
+
+	var prevBound, prevCount float64
+	for i, le := range bounds {
+		c := cumCounts[i] - prevCount
+		switch {
+		case i > 0:
+			h.addRange(prevBound, le, c)
+		case le > 0:
+			h.addRange(0, le, c)
+		default:
+			h.addPoint(le, c)
+		}
+		prevBound, prevCount = le, cumCounts[i]
+	}
+	if rest := count - prevCount; rest > 0 {
+		if prevBound >= h.ZeroThreshold {
+			h.Positive[Index(prevBound, schema)+1] += rest
+		} else {
+			h.addPoint(math.Nextafter(prevBound, math.Inf(1)), rest)
+		}
+	}
+	return h
+}
+
+// addPoint adds count observations of the value v.
+func (h *Histogram) addPoint(v, count float64) {
+	switch {
+	case math.Abs(v) <= h.ZeroThreshold:
+		h.ZeroCount += count
+	case v > 0:
+		h.Positive[Index(v, h.Schema)] += count
+	default:
+		h.Negative[Index(v, h.Schema)] += count
+	}
+}
+
+// addRange adds count observations uniformly distributed between lower
+// (exclusive) and upper (inclusive).
+func (h *Histogram) addRange(lower, upper, count float64) {
+	if count == 0 {
+		return
+	}
+	if upper <= lower || math.IsInf(lower, 0) || math.IsInf(upper, 0) {
+		h.addPoint(upper, count)
+		return
+	}
+	density := count / (upper - lower)
+	// Zero bucket.
+	if overlap := math.Min(upper, h.ZeroThreshold) - math.Max(lower, -h.ZeroThreshold); overlap > 0 {
+		h.ZeroCount += overlap * density
+	}
+	// Positive buckets.
+	if a, b := math.Max(lower, h.ZeroThreshold), upper; a < b {
+		h.addAbsRange(h.Positive, a, b, density)
+	}
+	// Negative buckets, mirrored to positive values.
+	if a, b := math.Max(-upper, h.ZeroThreshold), -lower; a < b {
+		h.addAbsRange(h.Negative, a, b, density)
+	}
+}
+
+// addAbsRange adds observations with the given density between the positive
+// values a and b to buckets.
+func (h *Histogram) addAbsRange(buckets map[int32]float64, a, b, density float64) {
+	for idx := Index(a, h.Schema); idx <= Index(b, h.Schema); idx++ {
+		overlap := math.Min(b, UpperBound(idx, h.Schema)) - math.Max(a, UpperBound(idx-1, h.Schema))
+		if overlap > 0 {
+			buckets[idx] += overlap * density
+		}
+	}
+}
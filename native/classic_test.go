@@ -0,0 +1,102 @@
+package native
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCumulativeCountBounds(t *testing.T) {
+	// Schema 0: Buckets (0.5, 1], (1, 2], (2, 4], and [-2, -1).
+	h := &Histogram{
+		Schema: 0, ZeroThreshold: 0.25, Count: 10, ZeroCount: 1,
+		Positive: map[int32]float64{0: 2, 1: 3, 2: 1},
+		Negative: map[int32]float64{1: 3},
+	}
+	scenarios := []struct {
+		le             float64
+		wantLo, wantHi float64
+	}{
+		{le: -3, wantLo: 0, wantHi: 0},
+		{le: -2, wantLo: 0, wantHi: 3}, // Lower bound of the negative bucket is inclusive.
+		{le: -1, wantLo: 3, wantHi: 3},
+		{le: 0, wantLo: 3, wantHi: 4},
+		{le: 0.25, wantLo: 4, wantHi: 4},
+		{le: 0.5, wantLo: 4, wantHi: 4},
+		{le: 0.75, wantLo: 4, wantHi: 6},
+		{le: 1, wantLo: 6, wantHi: 6},
+		{le: 1.5, wantLo: 6, wantHi: 9},
+		{le: 2, wantLo: 9, wantHi: 9},
+		{le: 10, wantLo: 10, wantHi: 10},
+	}
+	for _, s := range scenarios {
+		lo, hi := h.CumulativeCountBounds(s.le)
+		if lo != s.wantLo || hi != s.wantHi {
+			t.Errorf("le=%g: got [%g, %g], want [%g, %g]", s.le, lo, hi, s.wantLo, s.wantHi)
+		}
+	}
+}
+
+func TestCumulativeCount(t *testing.T) {
+	h := &Histogram{
+		Schema: 0, ZeroThreshold: 0.5, Count: 7, ZeroCount: 2,
+		Positive: map[int32]float64{1: 4, 2: 1},
+		Negative: map[int32]float64{},
+	}
+	got := h.ToClassic([]float64{0.25, 0.5, 1, 1.5, 2, 3, 4})
+	want := []float64{1, 2, 2, 4, 6, 6.5, 7}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNearestSchema(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		bounds []float64
+		want   int32
+	}{
+		{"DefBuckets", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, 0},
+		{"factor 1.1", []float64{1, 1.1, 1.21, 1.331, 1.4641}, 3},
+		{"factor 16", []float64{1, 16, 256, 4096}, -2},
+		{"factor 1.0001", []float64{1, 1.0001, 1.00020001}, MaxSchema},
+		{"single bound", []float64{1}, 0},
+		{"only non-positive bounds", []float64{-2, -1, 0}, 0},
+	}
+	for _, s := range scenarios {
+		if got := NearestSchema(s.bounds); got != s.want {
+			t.Errorf("%s: got schema %d, want %d", s.name, got, s.want)
+		}
+	}
+}
+
+func TestFromClassic(t *testing.T) {
+	bounds := []float64{1, 2, 4}
+	cumCounts := []float64{2, 5, 6}
+	h := FromClassic(bounds, cumCounts, 7, 12, 0)
+	want := &Histogram{
+		Schema: 0, ZeroThreshold: 1, ZeroCount: 2, Count: 7, Sum: 12,
+		Positive: map[int32]float64{1: 3, 2: 1, 3: 1},
+		Negative: map[int32]float64{},
+		IsFloat:  true,
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %+v, want %+v", h, want)
+	}
+	if got := h.ToClassic(bounds); !reflect.DeepEqual(got, cumCounts) {
+		t.Errorf("converting back: got %v, want %v", got, cumCounts)
+	}
+
+	// A classic bucket spanning several native buckets.
+	h = FromClassic([]float64{1, 8}, []float64{0, 7}, 7, 30, 0)
+	wantPositive := map[int32]float64{1: 1, 2: 2, 3: 4}
+	if !reflect.DeepEqual(h.Positive, wantPositive) {
+		t.Errorf("got positive buckets %v, want %v", h.Positive, wantPositive)
+	}
+
+	// Negative bounds.
+	h = FromClassic([]float64{-4, -1, 1}, []float64{1, 4, 6}, 6, -5, 0)
+	wantNegative := map[int32]float64{2: 1 + 2, 1: 1}
+	if !reflect.DeepEqual(h.Negative, wantNegative) || h.ZeroCount != 2 {
+		t.Errorf("got negative buckets %v and zero count %g, want %v and 2", h.Negative, h.ZeroCount, wantNegative)
+	}
+}
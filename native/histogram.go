@@ -0,0 +1,226 @@
+// Package native provides arithmetic on native histograms as exposed in the
+// protobuf format, e.g. merging histograms with different schemas and zero
+// thresholds.
+package native
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Supported range of schemas, following Prometheus.
+const (
+	MinSchema = -4
+	MaxSchema = 8
+)
+
+// Histogram is a decoded native histogram. Unlike the protobuf representation,
+// it contains absolute counts for each populated bucket, keyed by bucket
+// index, which makes it easy to do arithmetic with it. Counts are float64 so
+// that integer and float histograms can be handled alike.
+type Histogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     float64
+	Count, Sum    float64
+	// Positive and Negative contain the count of each populated bucket.
+	Positive, Negative map[int32]float64
+	// IsFloat is true if the histogram was decoded from (or should be
+	// encoded to) the float flavor of the protobuf representation.
+	IsFloat bool
+}
+
+// New returns an empty Histogram with the given schema and zero threshold.
+func New(schema int32, zeroThreshold float64) *Histogram {
+	return &Histogram{
+		Schema:        schema,
+		ZeroThreshold: zeroThreshold,
+		Positive:      map[int32]float64{},
+		Negative:      map[int32]float64{},
+	}
+}
+
+// Decode converts the native part of h into a Histogram. Classic buckets in h
+// are ignored. An error is returned if the spans and the bucket counts
+// don't match.
+func Decode(h *dto.Histogram) (*Histogram, error) {
+	if s := h.GetSchema(); s < MinSchema || s > MaxSchema {
+		return nil, fmt.Errorf("schema %d out of range", s)
+	}
+	d := New(h.GetSchema(), h.GetZeroThreshold())
+	d.IsFloat = h.SampleCountFloat != nil || h.ZeroCountFloat != nil ||
+		len(h.GetPositiveCount()) > 0 || len(h.GetNegativeCount()) > 0
+	if d.IsFloat {
+		d.Count = h.GetSampleCountFloat()
+		d.ZeroCount = h.GetZeroCountFloat()
+	} else {
+		d.Count = float64(h.GetSampleCount())
+		d.ZeroCount = float64(h.GetZeroCount())
+	}
+	d.Sum = h.GetSampleSum()
+	if err := decodeBuckets(d.Positive, h.GetPositiveSpan(), h.GetPositiveDelta(), h.GetPositiveCount()); err != nil {
+		return nil, fmt.Errorf("positive buckets: %w", err)
+	}
+	if err := decodeBuckets(d.Negative, h.GetNegativeSpan(), h.GetNegativeDelta(), h.GetNegativeCount()); err != nil {
+		return nil, fmt.Errorf("negative buckets: %w", err)
+	}
+	return d, nil
+}
+
+func decodeBuckets(buckets map[int32]float64, spans []*dto.BucketSpan, deltas []int64, counts []float64) error {
+	n := len(deltas)
+	if len(counts) > 0 {
+		if n > 0 {
+			return fmt.Errorf("both %d deltas and %d float counts present", n, len(counts))
+		}
+		n = len(counts)
+	}
+	var (
+		idx   int32
+		pos   int
+		count int64
+	)
+	for _, span := range spans {
+		idx += span.GetOffset()
+		for end := idx + int32(span.GetLength()); idx < end; idx++ {
+			if pos >= n {
+				return fmt.Errorf("spans describe more than %d buckets", n)
+			}
+			if len(counts) > 0 {
+				buckets[idx] += counts[pos]
+			} else {
+				count += deltas[pos]
+				buckets[idx] += float64(count)
+			}
+			pos++
+		}
+	}
+	if pos != n {
+		return fmt.Errorf("spans describe %d buckets, but there are %d counts", pos, n)
+	}
+	return nil
+}
+
+// Encode converts the Histogram into its protobuf representation. Empty
+// buckets are omitted, and a minimal set of spans is created, i.e. a new span
+// is only started if there is a gap between populated buckets.
+func (h *Histogram) Encode() *dto.Histogram {
+	e := &dto.Histogram{
+		SampleSum:     proto.Float64(h.Sum),
+		Schema:        proto.Int32(h.Schema),
+		ZeroThreshold: proto.Float64(h.ZeroThreshold),
+	}
+	if h.IsFloat {
+		e.SampleCountFloat = proto.Float64(h.Count)
+		e.ZeroCountFloat = proto.Float64(h.ZeroCount)
+	} else {
+		e.SampleCount = proto.Uint64(uint64(math.Round(h.Count)))
+		e.ZeroCount = proto.Uint64(uint64(math.Round(h.ZeroCount)))
+	}
+	e.PositiveSpan, e.PositiveDelta, e.PositiveCount = encodeBuckets(h.Positive, h.IsFloat)
+	e.NegativeSpan, e.NegativeDelta, e.NegativeCount = encodeBuckets(h.Negative, h.IsFloat)
+	return e
+}
+
+func encodeBuckets(buckets map[int32]float64, isFloat bool) (spans []*dto.BucketSpan, deltas []int64, counts []float64) {
+	var (
+		prevIdx   int32
+		prevCount int64
+	)
+	for i, idx := range SortedIndices(buckets) {
+		switch {
+		case i == 0:
+			spans = append(spans, &dto.BucketSpan{Offset: proto.Int32(idx), Length: proto.Uint32(1)})
+		case idx == prevIdx+1:
+			*spans[len(spans)-1].Length++
+		default:
+			spans = append(spans, &dto.BucketSpan{Offset: proto.Int32(idx - prevIdx - 1), Length: proto.Uint32(1)})
+		}
+		prevIdx = idx
+		if isFloat {
+			counts = append(counts, buckets[idx])
+			continue
+		}
+		count := int64(math.Round(buckets[idx]))
+		deltas = append(deltas, count-prevCount)
+		prevCount = count
+	}
+	return spans, deltas, counts
+}
+
+// SortedIndices returns the indices of the populated buckets in ascending
+// order. Buckets with a count of zero are considered unpopulated.
+func SortedIndices(buckets map[int32]float64) []int32 {
+	indices := make([]int32, 0, len(buckets))
+	for idx, count := range buckets {
+		if count != 0 {
+			indices = append(indices, idx)
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	return indices
+}
+
+// Copy returns a deep copy of the Histogram.
+func (h *Histogram) Copy() *Histogram {
+	c := *h
+	c.Positive = make(map[int32]float64, len(h.Positive))
+	c.Negative = make(map[int32]float64, len(h.Negative))
+	for idx, count := range h.Positive {
+		c.Positive[idx] = count
+	}
+	for idx, count := range h.Negative {
+		c.Negative[idx] = count
+	}
+	return &c
+}
+
+// UpperBound returns the upper bound of the positive bucket with the given
+// index in the given schema. (The lower bound of the negative bucket with the
+// same index is the negated value.) Powers of two are calculated precisely.
+func UpperBound(idx, schema int32) float64 {
+	if schema <= 0 {
+		return math.Ldexp(1, int(idx)<<-schema)
+	}
+	if idx%(1<<schema) == 0 {
+		return math.Ldexp(1, int(idx>>schema))
+	}
+	return math.Exp2(float64(idx) / float64(int32(1)<<schema))
+}
+
+// Index returns the index of the bucket v falls into for the given schema,
+// ignoring the sign of v and the zero bucket. Like client_golang, it puts ±Inf
+// into the bucket following the one of ±math.MaxFloat64 (whose upper bound is
+// infinite). NaN doesn't belong into any bucket (client_golang only counts it),
+// so callers have to handle it separately. Index returns 0 for it.
+func Index(v float64, schema int32) int32 {
+	switch {
+	case math.IsNaN(v):
+		return 0
+	case math.IsInf(v, 0):
+		return Index(math.MaxFloat64, schema) + 1
+	}
+	frac, exp := math.Frexp(math.Abs(v))
+	if schema > 0 {
+		idx := int32(math.Ceil((math.Log2(frac) + float64(exp)) * float64(int32(1)<<schema)))
+		// Correct floating point imprecision at the boundaries.
+		if UpperBound(idx-1, schema) >= math.Abs(v) {
+			idx--
+		} else if UpperBound(idx, schema) < math.Abs(v) {
+			idx++
+		}
+		return idx
+	}
+	idx := int32(exp)
+	if frac == 0.5 {
+		idx--
+	}
+	// Round up the division towards +Inf (as idx might be negative).
+	div := int32(1) << -schema
+	return int32(math.Ceil(float64(idx) / float64(div)))
+}
@@ -0,0 +1,162 @@
+package native
+
+import (
+	"errors"
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Merge sums up the native parts of the provided histograms, as an
+// aggregation across instances would do. Histograms with different schemas
+// are downscaled to the coarsest schema among them. Histograms with different
+// zero thresholds are converted to the largest zero threshold among them (or
+// an even larger one, see WidenZeroBucket). The result has a minimal span
+// layout. If any of the histograms is a float histogram, the result is a float
+// histogram, too.
+func Merge(hs ...*dto.Histogram) (*dto.Histogram, error) {
+	if len(hs) == 0 {
+		return nil, errors.New("no histograms to merge")
+	}
+	ds := make([]*Histogram, 0, len(hs))
+	for i, h := range hs {
+		d, err := Decode(h)
+		if err != nil {
+			return nil, fmt.Errorf("histogram %d: %w", i, err)
+		}
+		ds = append(ds, d)
+	}
+	return Add(ds...).Encode(), nil
+}
+
+// Add is like Merge but works on decoded histograms. The provided histograms
+// are not modified. Add returns nil if no histograms are provided.
+func Add(hs ...*Histogram) *Histogram {
+	if len(hs) == 0 {
+		return nil
+	}
+	cs := reconcile(hs...)
+	sum := New(cs[0].Schema, cs[0].ZeroThreshold)
+	for _, c := range cs {
+		sum.IsFloat = sum.IsFloat || c.IsFloat
+		sum.Count += c.Count
+		sum.Sum += c.Sum
+		sum.ZeroCount += c.ZeroCount
+		for idx, count := range c.Positive {
+			sum.Positive[idx] += count
+		}
+		for idx, count := range c.Negative {
+			sum.Negative[idx] += count
+		}
+	}
+	return sum
+}
+
+// reconcile returns copies of the provided histograms, all converted to the
+// coarsest schema and a common zero threshold (the largest one, or an even
+// larger one, see ZeroThresholdFor).
+func reconcile(hs ...*Histogram) []*Histogram {
+	schema, threshold := hs[0].Schema, hs[0].ZeroThreshold
+	for _, h := range hs[1:] {
+		if h.Schema < schema {
+			schema = h.Schema
+		}
+		if h.ZeroThreshold > threshold {
+			threshold = h.ZeroThreshold
+		}
+	}
+
+	cs := make([]*Histogram, len(hs))
+	for i, h := range hs {
+		cs[i] = h.Copy()
+		cs[i].Downscale(schema)
+	}
+	// Widening the zero bucket of one histogram might require a threshold
+	// larger than the largest one to avoid splitting a bucket. That in
+	// turn might affect the other histograms. Thus, repeat until stable.
+	for changed := true; changed; {
+		changed = false
+		for _, c := range cs {
+			if t := c.ZeroThresholdFor(threshold); t > threshold {
+				threshold = t
+				changed = true
+			}
+		}
+	}
+	for _, c := range cs {
+		c.WidenZeroBucket(threshold)
+	}
+	return cs
+}
+
+// Downscale reduces the resolution of the Histogram to the given schema by
+// merging buckets. It does nothing if the schema of the Histogram is already
+// at or below the given schema.
+func (h *Histogram) Downscale(schema int32) {
+	if schema >= h.Schema {
+		return
+	}
+	delta := h.Schema - schema
+	h.Positive = downscaleBuckets(h.Positive, delta)
+	h.Negative = downscaleBuckets(h.Negative, delta)
+	h.Schema = schema
+}
+
+func downscaleBuckets(buckets map[int32]float64, delta int32) map[int32]float64 {
+	result := make(map[int32]float64, len(buckets))
+	for idx, count := range buckets {
+		// The upper bound of bucket idx is 2^(idx/2^schema). Shifting
+		// idx-1 rather than idx makes sure the bucket ending exactly
+		// at a boundary of the coarser schema ends up in the bucket
+		// with that upper bound.
+		result[((idx-1)>>delta)+1] += count
+	}
+	return result
+}
+
+// ZeroThresholdFor returns the zero threshold the Histogram would end up with
+// if the zero bucket were widened to the given threshold. That's the given
+// threshold itself, unless it falls into a populated bucket, in which case it
+// is increased to the upper bound of that bucket so that the bucket is merged
+// completely into the zero bucket. The result is never smaller than the
+// current threshold.
+func (h *Histogram) ZeroThresholdFor(threshold float64) float64 {
+	if threshold <= h.ZeroThreshold {
+		return h.ZeroThreshold
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, buckets := range []map[int32]float64{h.Positive, h.Negative} {
+			for idx, count := range buckets {
+				if count == 0 {
+					continue
+				}
+				if upper := UpperBound(idx, h.Schema); UpperBound(idx-1, h.Schema) < threshold && threshold < upper {
+					threshold = upper
+					changed = true
+				}
+			}
+		}
+	}
+	return threshold
+}
+
+// WidenZeroBucket increases the zero threshold of the Histogram to the result
+// of ZeroThresholdFor(threshold) and merges all buckets below it into the zero
+// bucket. It returns the new threshold.
+func (h *Histogram) WidenZeroBucket(threshold float64) float64 {
+	threshold = h.ZeroThresholdFor(threshold)
+	if threshold == h.ZeroThreshold {
+		return threshold
+	}
+	for _, buckets := range []map[int32]float64{h.Positive, h.Negative} {
+		for idx, count := range buckets {
+			if UpperBound(idx, h.Schema) <= threshold {
+				h.ZeroCount += count
+				delete(buckets, idx)
+			}
+		}
+	}
+	h.ZeroThreshold = threshold
+	return threshold
+}
@@ -0,0 +1,325 @@
+package native
+
+import (
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/beorn7/histogram_experiments/dataset"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// readDataset reads the values from a dataset file.
+func readDataset(t *testing.T, name string) []float64 {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var (
+		vals []float64
+		r    = dataset.NewReader(f)
+	)
+	for {
+		o, err := r.Read()
+		if err == io.EOF {
+			return vals
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals = append(vals, o.Value)
+	}
+}
+
+// exposeHistogram creates a histogram the same way the exposer does, observes
+// vals, and returns the resulting protobuf message.
+func exposeHistogram(t *testing.T, factor, zeroThreshold float64, vals []float64) *dto.Histogram {
+	t.Helper()
+	his := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                         "histogram_experiment",
+		Help:                         "Test histogram for an experiment.",
+		NativeHistogramBucketFactor:  factor,
+		NativeHistogramZeroThreshold: zeroThreshold,
+	})
+	for _, v := range vals {
+		his.Observe(v)
+	}
+	var m dto.Metric
+	if err := his.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	h := m.GetHistogram()
+	// Remove the (empty) classic +Inf bucket and the created timestamp to
+	// allow comparison with merge results.
+	h.Bucket, h.CreatedTimestamp = nil, nil
+	return h
+}
+
+func TestMergeExposedHistograms(t *testing.T) {
+	vals := readDataset(t, "../datasets/spamd.20190918")
+
+	instances := []struct {
+		factor, zeroThreshold float64
+	}{
+		{1.1, 0.25},  // Schema 3.
+		{1.5, 0.125}, // Schema 1.
+		{2, 0.5},     // Schema 0.
+		{1.1, 1e-128},
+	}
+	var hs []*dto.Histogram
+	for i, inst := range instances {
+		var instVals []float64
+		for j := i; j < len(vals); j += len(instances) {
+			instVals = append(instVals, vals[j])
+		}
+		hs = append(hs, exposeHistogram(t, inst.factor, inst.zeroThreshold, instVals))
+	}
+
+	got, err := Merge(hs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Observing everything into a single histogram with the coarsest
+	// schema and the widest zero bucket has to yield the same result. (The
+	// zero thresholds are chosen to be powers of two, so that they never
+	// fall into a bucket.)
+	want := exposeHistogram(t, 2, 0.5, vals)
+
+	if math.Abs(got.GetSampleSum()-want.GetSampleSum()) > 1e-6 {
+		t.Errorf("got sum %g, want %g", got.GetSampleSum(), want.GetSampleSum())
+	}
+	got.SampleSum, want.SampleSum = nil, nil
+	if !proto.Equal(got, want) {
+		t.Errorf("merged histogram differs:\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+func TestMergeMixedSchemasAndThresholds(t *testing.T) {
+	scenarios := []struct {
+		name string
+		in   []*Histogram
+		want *Histogram
+	}{
+		{
+			name: "downscale",
+			in: []*Histogram{
+				{
+					Schema: 1, ZeroThreshold: 0.001, Count: 6, Sum: 10, ZeroCount: 1,
+					Positive: map[int32]float64{1: 1, 2: 2, 3: 1},
+					Negative: map[int32]float64{-2: 1},
+				},
+				{
+					Schema: 0, ZeroThreshold: 0.001, Count: 2, Sum: 3,
+					Positive: map[int32]float64{2: 2},
+					Negative: map[int32]float64{},
+				},
+			},
+			want: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 8, Sum: 13, ZeroCount: 1,
+				Positive: map[int32]float64{1: 3, 2: 3},
+				Negative: map[int32]float64{-1: 1},
+			},
+		},
+		{
+			name: "widen zero bucket to bucket boundary",
+			in: []*Histogram{
+				{
+					Schema: 0, ZeroThreshold: 0.001, Count: 4, Sum: 1, ZeroCount: 1,
+					Positive: map[int32]float64{-1: 1, 0: 1},
+					Negative: map[int32]float64{-2: 1},
+				},
+				{
+					Schema: 0, ZeroThreshold: 0.5, Count: 3, Sum: 1, ZeroCount: 2,
+					Positive: map[int32]float64{0: 1},
+					Negative: map[int32]float64{},
+				},
+			},
+			want: &Histogram{
+				Schema: 0, ZeroThreshold: 0.5, Count: 7, Sum: 2, ZeroCount: 5,
+				Positive: map[int32]float64{0: 2},
+				Negative: map[int32]float64{},
+			},
+		},
+		{
+			name: "zero threshold falls into populated bucket",
+			in: []*Histogram{
+				{
+					Schema: 0, ZeroThreshold: 0.001, Count: 3, Sum: 1.5,
+					Positive: map[int32]float64{0: 2, 1: 1},
+					Negative: map[int32]float64{},
+				},
+				{
+					Schema: 0, ZeroThreshold: 0.7, Count: 1, Sum: 0.1, ZeroCount: 1,
+					Positive: map[int32]float64{},
+					Negative: map[int32]float64{},
+				},
+			},
+			want: &Histogram{
+				Schema: 0, ZeroThreshold: 1, Count: 4, Sum: 1.6, ZeroCount: 3,
+				Positive: map[int32]float64{1: 1},
+				Negative: map[int32]float64{},
+			},
+		},
+		{
+			name: "float histogram",
+			in: []*Histogram{
+				{
+					Schema: 2, ZeroThreshold: 0.001, Count: 1.5, Sum: 2,
+					Positive: map[int32]float64{4: 1.5},
+					Negative: map[int32]float64{},
+					IsFloat:  true,
+				},
+				{
+					Schema: 2, ZeroThreshold: 0.001, Count: 1, Sum: 2,
+					Positive: map[int32]float64{4: 1},
+					Negative: map[int32]float64{},
+				},
+			},
+			want: &Histogram{
+				Schema: 2, ZeroThreshold: 0.001, Count: 2.5, Sum: 4,
+				Positive: map[int32]float64{4: 2.5},
+				Negative: map[int32]float64{},
+				IsFloat:  true,
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var copies []*Histogram
+			for _, h := range s.in {
+				copies = append(copies, h.Copy())
+			}
+			got := Add(s.in...)
+			if math.Abs(got.Sum-s.want.Sum) > 1e-9 {
+				t.Errorf("got sum %g, want %g", got.Sum, s.want.Sum)
+			}
+			got.Sum = s.want.Sum
+			if !reflect.DeepEqual(got, s.want) {
+				t.Errorf("got %+v, want %+v", got, s.want)
+			}
+			if !reflect.DeepEqual(s.in, copies) {
+				t.Error("input histograms have been modified")
+			}
+		})
+	}
+}
+
+func TestEncodeMinimalSpans(t *testing.T) {
+	h := &Histogram{
+		Schema: 3, ZeroThreshold: 0.001, Count: 10, Sum: 42,
+		// Bucket 1 is explicitly empty, 7 and 8 are a gap.
+		Positive: map[int32]float64{-2: 1, -1: 2, 0: 2, 1: 0, 2: 1, 3: 1, 9: 2},
+		Negative: map[int32]float64{},
+	}
+	got := h.Encode()
+	want := &dto.Histogram{
+		SampleCount:   proto.Uint64(10),
+		SampleSum:     proto.Float64(42),
+		Schema:        proto.Int32(3),
+		ZeroThreshold: proto.Float64(0.001),
+		ZeroCount:     proto.Uint64(0),
+		PositiveSpan: []*dto.BucketSpan{
+			{Offset: proto.Int32(-2), Length: proto.Uint32(3)},
+			{Offset: proto.Int32(1), Length: proto.Uint32(2)},
+			{Offset: proto.Int32(5), Length: proto.Uint32(1)},
+		},
+		PositiveDelta: []int64{1, 1, 0, -1, 0, 1},
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	d, err := Decode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(h.Positive, 1)
+	if !reflect.DeepEqual(d, h) {
+		t.Errorf("round trip: got %+v, want %+v", d, h)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	scenarios := map[string]*dto.Histogram{
+		"too few deltas": {
+			PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(3)}},
+			PositiveDelta: []int64{1, 1},
+		},
+		"too many deltas": {
+			NegativeSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(1)}},
+			NegativeDelta: []int64{1, 1},
+		},
+		"deltas and counts": {
+			PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(1)}},
+			PositiveDelta: []int64{1},
+			PositiveCount: []float64{1},
+		},
+		"schema out of range": {
+			Schema: proto.Int32(9),
+		},
+	}
+	for name, h := range scenarios {
+		if _, err := Decode(h); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	for schema := int32(MinSchema); schema <= MaxSchema; schema++ {
+		for idx := int32(-50); idx <= 50; idx++ {
+			upper := UpperBound(idx, schema)
+			if got := Index(upper, schema); got != idx {
+				t.Errorf("schema %d: Index(%g) = %d, want %d", schema, upper, got, idx)
+			}
+			if got := Index(-upper, schema); got != idx {
+				t.Errorf("schema %d: Index(%g) = %d, want %d", schema, -upper, got, idx)
+			}
+			if got := Index(math.Nextafter(upper, math.Inf(1)), schema); got != idx+1 {
+				t.Errorf("schema %d: Index(just above %g) = %d, want %d", schema, upper, got, idx+1)
+			}
+		}
+	}
+}
+
+func TestIndexNonFinite(t *testing.T) {
+	// The largest finite float64 is just below 2^1024, so it falls into the
+	// bucket with upper bound 2^1024 (index 1024 for schema 0, the bound
+	// itself overflows to +Inf), and ±Inf into the next one, like in
+	// client_golang.
+	scenarios := []struct {
+		schema   int32
+		max      int32
+		overflow int32
+	}{
+		{-4, 64, 65},
+		{0, 1024, 1025},
+		{3, 8192, 8193},
+		{8, 262144, 262145},
+	}
+	for _, s := range scenarios {
+		if got := Index(math.MaxFloat64, s.schema); got != s.max {
+			t.Errorf("schema %d: Index(MaxFloat64) = %d, want %d", s.schema, got, s.max)
+		}
+		for _, v := range []float64{math.Inf(1), math.Inf(-1)} {
+			if got := Index(v, s.schema); got != s.overflow {
+				t.Errorf("schema %d: Index(%g) = %d, want %d", s.schema, v, got, s.overflow)
+			}
+		}
+		if !math.IsInf(UpperBound(s.overflow, s.schema), 1) {
+			t.Errorf("schema %d: upper bound of bucket %d is finite", s.schema, s.overflow)
+		}
+		if got := Index(math.NaN(), s.schema); got != 0 {
+			t.Errorf("schema %d: Index(NaN) = %d, want 0", s.schema, got)
+		}
+	}
+}
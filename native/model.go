@@ -0,0 +1,48 @@
+package native
+
+import (
+	"github.com/prometheus/prometheus/model/histogram"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ToModel converts the native part of h into the representation used within
+// Prometheus (e.g. by the TSDB). Depending on whether h is an integer or a
+// float histogram, either the first or the second return value is non-nil.
+// Spans and bucket counts are taken over as they are, i.e. their consistency
+// is not checked.
+func ToModel(h *dto.Histogram) (*histogram.Histogram, *histogram.FloatHistogram) {
+	if h.SampleCountFloat != nil || h.ZeroCountFloat != nil ||
+		len(h.GetPositiveCount()) > 0 || len(h.GetNegativeCount()) > 0 {
+		return nil, &histogram.FloatHistogram{
+			Schema:          h.GetSchema(),
+			ZeroThreshold:   h.GetZeroThreshold(),
+			ZeroCount:       h.GetZeroCountFloat(),
+			Count:           h.GetSampleCountFloat(),
+			Sum:             h.GetSampleSum(),
+			PositiveSpans:   toModelSpans(h.GetPositiveSpan()),
+			NegativeSpans:   toModelSpans(h.GetNegativeSpan()),
+			PositiveBuckets: h.GetPositiveCount(),
+			NegativeBuckets: h.GetNegativeCount(),
+		}
+	}
+	return &histogram.Histogram{
+		Schema:          h.GetSchema(),
+		ZeroThreshold:   h.GetZeroThreshold(),
+		ZeroCount:       h.GetZeroCount(),
+		Count:           h.GetSampleCount(),
+		Sum:             h.GetSampleSum(),
+		PositiveSpans:   toModelSpans(h.GetPositiveSpan()),
+		NegativeSpans:   toModelSpans(h.GetNegativeSpan()),
+		PositiveBuckets: h.GetPositiveDelta(),
+		NegativeBuckets: h.GetNegativeDelta(),
+	}, nil
+}
+
+func toModelSpans(spans []*dto.BucketSpan) []histogram.Span {
+	result := make([]histogram.Span, 0, len(spans))
+	for _, s := range spans {
+		result = append(result, histogram.Span{Offset: s.GetOffset(), Length: s.GetLength()})
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package native
+
+import (
+	"math"
+)
+
+// Quantile estimates the q-quantile (0 ≤ q ≤ 1) of the observations in the
+// Histogram in the same way as histogram_quantile in PromQL, assuming a
+// uniform distribution of observations within each bucket (i.e. linear
+// interpolation). The zero bucket is assumed to range from -ZeroThreshold to
+// +ZeroThreshold, or from 0 to +ZeroThreshold if there are no negative
+// buckets. The buckets closest to zero are assumed to start at the zero
+// threshold.
+//
+// NaN is returned for an empty histogram, -Inf for q < 0, and +Inf for q > 1.
+func (h *Histogram) Quantile(q float64) float64 {
+	switch {
+	case h.Count <= 0 || math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+
+	var (
+		rank = q * h.Count
+		cum  float64
+		// Returns the interpolated result if rank falls into the
+		// bucket [lower, upper] with the given count.
+		inBucket = func(lower, upper, count float64) (float64, bool) {
+			if count <= 0 || cum+count < rank {
+				cum += count
+				return 0, false
+			}
+			return lower + (upper-lower)*(rank-cum)/count, true
+		}
+		negIndices = SortedIndices(h.Negative)
+		posIndices = SortedIndices(h.Positive)
+	)
+
+	for i := len(negIndices) - 1; i >= 0; i-- {
+		idx := negIndices[i]
+		lower := -UpperBound(idx, h.Schema)
+		upper := math.Min(-UpperBound(idx-1, h.Schema), -h.ZeroThreshold)
+		if v, ok := inBucket(lower, upper, h.Negative[idx]); ok {
+			return v
+		}
+	}
+	zeroLower := -h.ZeroThreshold
+	if len(negIndices) == 0 {
+		zeroLower = 0
+	}
+	if v, ok := inBucket(zeroLower, h.ZeroThreshold, h.ZeroCount); ok {
+		return v
+	}
+	for _, idx := range posIndices {
+		lower := math.Max(UpperBound(idx-1, h.Schema), h.ZeroThreshold)
+		upper := UpperBound(idx, h.Schema)
+		if v, ok := inBucket(lower, upper, h.Positive[idx]); ok {
+			return v
+		}
+	}
+	// Rank is beyond the last bucket, which can happen if the count is
+	// larger than the sum of the bucket counts. Return the upper bound of
+	// the highest bucket, like PromQL does.
+	if len(posIndices) > 0 {
+		return UpperBound(posIndices[len(posIndices)-1], h.Schema)
+	}
+	if h.ZeroCount > 0 {
+		return h.ZeroThreshold
+	}
+	if len(negIndices) > 0 {
+		return math.Min(-UpperBound(negIndices[0]-1, h.Schema), -h.ZeroThreshold)
+	}
+	return math.NaN()
+}
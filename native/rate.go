@@ -0,0 +1,87 @@
+package native
+
+import (
+	"fmt"
+	"time"
+)
+
+// DetectReset returns true if cur cannot be the result of further observations
+// into prev, i.e. if the histogram must have been reset in between. This
+// follows the logic Prometheus applies for native histograms: A reset happened
+// if the count went down, if the resolution went up, if the zero threshold went
+// down, or if any bucket count (after converting both histograms to the same
+// schema and zero threshold) went down.
+func DetectReset(prev, cur *Histogram) bool {
+	if cur.Count < prev.Count || cur.Schema > prev.Schema || cur.ZeroThreshold < prev.ZeroThreshold {
+		return true
+	}
+	cs := reconcile(prev, cur)
+	p, c := cs[0], cs[1]
+	if c.ZeroCount < p.ZeroCount {
+		return true
+	}
+	for idx, count := range p.Positive {
+		if c.Positive[idx] < count {
+			return true
+		}
+	}
+	for idx, count := range p.Negative {
+		if c.Negative[idx] < count {
+			return true
+		}
+	}
+	return false
+}
+
+// Increase returns the bucket-wise increase from prev to cur as a new
+// histogram. Schema and zero threshold of the result are the coarser and
+// larger ones, respectively, of the two histograms. If a counter reset is
+// detected (see DetectReset), the increase is assumed to be cur itself (as if
+// it had been preceded by an empty histogram), and the returned bool is true.
+// The provided histograms are not modified.
+func Increase(prev, cur *Histogram) (*Histogram, bool) {
+	if DetectReset(prev, cur) {
+		return cur.Copy(), true
+	}
+	cs := reconcile(prev, cur)
+	p, inc := cs[0], cs[1]
+	inc.IsFloat = p.IsFloat || inc.IsFloat
+	inc.Count -= p.Count
+	inc.Sum -= p.Sum
+	inc.ZeroCount -= p.ZeroCount
+	for idx, count := range p.Positive {
+		inc.Positive[idx] -= count
+	}
+	for idx, count := range p.Negative {
+		inc.Negative[idx] -= count
+	}
+	return inc, false
+}
+
+// Rate returns the per-second rate calculated from the increase (see Increase)
+// between prev and cur, which have been scraped interval apart. The result is
+// always a float histogram. Unlike the rate function in PromQL, no
+// extrapolation is performed. An error is returned if interval is not
+// positive, e.g. for repeated time stamps or after a clock step.
+func Rate(prev, cur *Histogram, interval time.Duration) (*Histogram, bool, error) {
+	if interval <= 0 {
+		return nil, false, fmt.Errorf("interval %v is not positive", interval)
+	}
+	rate, reset := Increase(prev, cur)
+	rate.Scale(1 / interval.Seconds())
+	rate.IsFloat = true
+	return rate, reset, nil
+}
+
+// Scale multiplies all counts and the sum of the Histogram by f.
+func (h *Histogram) Scale(f float64) {
+	h.Count *= f
+	h.Sum *= f
+	h.ZeroCount *= f
+	for idx := range h.Positive {
+		h.Positive[idx] *= f
+	}
+	for idx := range h.Negative {
+		h.Negative[idx] *= f
+	}
+}
@@ -0,0 +1,186 @@
+package native
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIncrease(t *testing.T) {
+	scenarios := []struct {
+		name      string
+		prev, cur *Histogram
+		want      *Histogram
+		wantReset bool
+	}{
+		{
+			name: "regular increase",
+			prev: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 3, Sum: 5, ZeroCount: 1,
+				Positive: map[int32]float64{1: 1, 2: 1},
+				Negative: map[int32]float64{},
+			},
+			cur: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 6, Sum: 9, ZeroCount: 1,
+				Positive: map[int32]float64{1: 2, 2: 1, 3: 1},
+				Negative: map[int32]float64{-1: 1},
+			},
+			want: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 3, Sum: 4, ZeroCount: 0,
+				Positive: map[int32]float64{1: 1, 2: 0, 3: 1},
+				Negative: map[int32]float64{-1: 1},
+			},
+		},
+		{
+			name: "schema reduced",
+			prev: &Histogram{
+				Schema: 1, ZeroThreshold: 0.001, Count: 2, Sum: 3,
+				Positive: map[int32]float64{1: 1, 2: 1},
+				Negative: map[int32]float64{},
+			},
+			cur: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 5, Sum: 8,
+				Positive: map[int32]float64{1: 4, 2: 1},
+				Negative: map[int32]float64{},
+			},
+			want: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 3, Sum: 5,
+				Positive: map[int32]float64{1: 2, 2: 1},
+				Negative: map[int32]float64{},
+			},
+		},
+		{
+			name: "zero bucket widened",
+			prev: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 2, Sum: 1,
+				Positive: map[int32]float64{-1: 1, 1: 1},
+				Negative: map[int32]float64{},
+			},
+			cur: &Histogram{
+				Schema: 0, ZeroThreshold: 0.5, Count: 4, Sum: 3, ZeroCount: 2,
+				Positive: map[int32]float64{1: 2},
+				Negative: map[int32]float64{},
+			},
+			want: &Histogram{
+				Schema: 0, ZeroThreshold: 0.5, Count: 2, Sum: 2, ZeroCount: 1,
+				Positive: map[int32]float64{1: 1},
+				Negative: map[int32]float64{},
+			},
+		},
+		{
+			name: "bucket decreased",
+			prev: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 2, Sum: 3,
+				Positive: map[int32]float64{1: 2},
+				Negative: map[int32]float64{},
+			},
+			cur: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 3, Sum: 7,
+				Positive: map[int32]float64{1: 1, 3: 2},
+				Negative: map[int32]float64{},
+			},
+			want: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 3, Sum: 7,
+				Positive: map[int32]float64{1: 1, 3: 2},
+				Negative: map[int32]float64{},
+			},
+			wantReset: true,
+		},
+		{
+			name: "schema increased",
+			prev: &Histogram{
+				Schema: 0, ZeroThreshold: 0.001, Count: 1, Sum: 2,
+				Positive: map[int32]float64{1: 1},
+				Negative: map[int32]float64{},
+			},
+			cur: &Histogram{
+				Schema: 1, ZeroThreshold: 0.001, Count: 2, Sum: 4,
+				Positive: map[int32]float64{2: 2},
+				Negative: map[int32]float64{},
+			},
+			want: &Histogram{
+				Schema: 1, ZeroThreshold: 0.001, Count: 2, Sum: 4,
+				Positive: map[int32]float64{2: 2},
+				Negative: map[int32]float64{},
+			},
+			wantReset: true,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			got, reset := Increase(s.prev, s.cur)
+			if reset != s.wantReset {
+				t.Errorf("got reset %t, want %t", reset, s.wantReset)
+			}
+			if !reflect.DeepEqual(got, s.want) {
+				t.Errorf("got %+v, want %+v", got, s.want)
+			}
+		})
+	}
+}
+
+func TestRate(t *testing.T) {
+	prev := &Histogram{
+		Schema: 0, ZeroThreshold: 0.001, Count: 10, Sum: 10,
+		Positive: map[int32]float64{1: 10},
+		Negative: map[int32]float64{},
+	}
+	cur := &Histogram{
+		Schema: 0, ZeroThreshold: 0.001, Count: 40, Sum: 70,
+		Positive: map[int32]float64{1: 20, 2: 20},
+		Negative: map[int32]float64{},
+	}
+	got, reset, err := Rate(prev, cur, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Histogram{
+		Schema: 0, ZeroThreshold: 0.001, Count: 3, Sum: 6,
+		Positive: map[int32]float64{1: 1, 2: 2},
+		Negative: map[int32]float64{},
+		IsFloat:  true,
+	}
+	if reset {
+		t.Error("unexpected reset")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if got, _, err := Rate(prev, cur, interval); err == nil {
+			t.Errorf("interval %v: expected error, got %+v", interval, got)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	h := &Histogram{
+		Schema: 0, ZeroThreshold: 0.5, Count: 10, ZeroCount: 2,
+		// Buckets (-2, -1], (0.5, 1], (1, 2], (2, 4].
+		Positive: map[int32]float64{0: 2, 1: 2, 2: 2},
+		Negative: map[int32]float64{1: 2},
+	}
+	scenarios := []struct {
+		q, want float64
+	}{
+		{-0.1, math.Inf(-1)},
+		{0, -2},
+		{0.1, -1.5},
+		{0.3, 0},
+		{0.5, 0.75},
+		{0.7, 1.5},
+		{1, 4},
+		{1.1, math.Inf(1)},
+	}
+	for _, s := range scenarios {
+		if got := h.Quantile(s.q); got != s.want {
+			t.Errorf("Quantile(%g) = %g, want %g", s.q, got, s.want)
+		}
+	}
+	if got := New(0, 0.001).Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("Quantile of empty histogram = %g, want NaN", got)
+	}
+}
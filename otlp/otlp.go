@@ -0,0 +1,157 @@
+// Package otlp converts native histograms into OpenTelemetry exponential
+// histograms and back, and sends and receives them via OTLP/HTTP. Both use the
+// same base-2 exponential bucketing: The OTLP scale is the native histogram
+// schema, and the OTLP bucket with index i is the native histogram bucket with
+// index i+1. Both are upper-inclusive, but OTLP indexes a bucket by its lower
+// bound, (base^i, base^(i+1)], while native histograms index it by its upper
+// bound, (base^(i-1), base^i].
+package otlp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+
+	"github.com/beorn7/histogram_experiments/native"
+)
+
+const contentType = "application/x-protobuf"
+
+// ParseTemporality parses "cumulative" or "delta".
+func ParseTemporality(s string) (pmetric.AggregationTemporality, error) {
+	switch s {
+	case "cumulative":
+		return pmetric.AggregationTemporalityCumulative, nil
+	case "delta":
+		return pmetric.AggregationTemporalityDelta, nil
+	}
+	return pmetric.AggregationTemporalityUnspecified, fmt.Errorf("unknown temporality %q", s)
+}
+
+// FromNative sets scale, zero bucket, buckets, count, and sum of dp from h.
+// OTLP only knows integer counts, so float counts are rounded.
+func FromNative(h *native.Histogram, dp pmetric.ExponentialHistogramDataPoint) {
+	dp.SetScale(h.Schema)
+	dp.SetZeroThreshold(h.ZeroThreshold)
+	dp.SetZeroCount(round(h.ZeroCount))
+	dp.SetCount(round(h.Count))
+	dp.SetSum(h.Sum)
+	fromNativeBuckets(h.Positive, dp.Positive())
+	fromNativeBuckets(h.Negative, dp.Negative())
+}
+
+func fromNativeBuckets(buckets map[int32]float64, b pmetric.ExponentialHistogramDataPointBuckets) {
+	idxs := native.SortedIndices(buckets)
+	if len(idxs) == 0 {
+		return
+	}
+	first, last := idxs[0], idxs[len(idxs)-1]
+	counts := make([]uint64, last-first+1)
+	for _, idx := range idxs {
+		counts[idx-first] = round(buckets[idx])
+	}
+	b.SetOffset(first - 1)
+	b.BucketCounts().FromRaw(counts)
+}
+
+// ToNative returns the native histogram represented by dp. Empty buckets are
+// dropped.
+func ToNative(dp pmetric.ExponentialHistogramDataPoint) *native.Histogram {
+	h := native.New(dp.Scale(), dp.ZeroThreshold())
+	h.ZeroCount = float64(dp.ZeroCount())
+	h.Count = float64(dp.Count())
+	h.Sum = dp.Sum()
+	toNativeBuckets(dp.Positive(), h.Positive)
+	toNativeBuckets(dp.Negative(), h.Negative)
+	return h
+}
+
+func toNativeBuckets(b pmetric.ExponentialHistogramDataPointBuckets, buckets map[int32]float64) {
+	for i, count := range b.BucketCounts().AsRaw() {
+		if count > 0 {
+			buckets[b.Offset()+int32(i)+1] = float64(count)
+		}
+	}
+}
+
+func round(f float64) uint64 {
+	return uint64(math.Round(f))
+}
+
+// Exporter pushes a single native histogram as an OTLP ExponentialHistogram.
+type Exporter struct {
+	client      *http.Client
+	url, name   string
+	temporality pmetric.AggregationTemporality
+
+	start, last time.Time // Start of the current cumulative series and time of the last push.
+	prev        *native.Histogram
+}
+
+// NewExporter returns an Exporter pushing a histogram with the given metric
+// name to url. start is the time the histogram was created.
+func NewExporter(url, name string, temporality pmetric.AggregationTemporality, start time.Time) *Exporter {
+	return &Exporter{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		url:         url,
+		name:        name,
+		temporality: temporality,
+		start:       start,
+		last:        start,
+	}
+}
+
+// Export pushes h, observed at ts. With delta temporality, the increase since
+// the previous push is sent. The returned int is the size of the request body.
+func (e *Exporter) Export(h *native.Histogram, ts time.Time) (int, error) {
+	md := pmetric.NewMetrics()
+	m := md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	m.SetName(e.name)
+	eh := m.SetEmptyExponentialHistogram()
+	eh.SetAggregationTemporality(e.temporality)
+	dp := eh.DataPoints().AppendEmpty()
+
+	sent, reset := h, false
+	if e.prev != nil {
+		reset = native.DetectReset(e.prev, h)
+		if e.temporality == pmetric.AggregationTemporalityDelta {
+			sent, _ = native.Increase(e.prev, h)
+		}
+	}
+	switch {
+	case e.temporality == pmetric.AggregationTemporalityDelta:
+		dp.SetStartTimestamp(pcommon.NewTimestampFromTime(e.last))
+	case reset:
+		// We don't know when exactly the reset happened, the last push
+		// is the best guess we have.
+		e.start = e.last
+		fallthrough
+	default:
+		dp.SetStartTimestamp(pcommon.NewTimestampFromTime(e.start))
+	}
+	dp.SetTimestamp(pcommon.NewTimestampFromTime(ts))
+	FromNative(sent, dp)
+
+	body, err := pmetricotlp.NewExportRequestFromMetrics(md).MarshalProto()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := e.client.Post(e.url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return len(body), err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return len(body), fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	e.prev, e.last = h, ts
+	return len(body), nil
+}
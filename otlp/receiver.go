@@ -0,0 +1,122 @@
+package otlp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+
+	"github.com/beorn7/histogram_experiments/native"
+)
+
+// Receiver is a stand-in for an OTLP/HTTP metrics endpoint. It converts
+// received exponential histograms back into native histograms and logs the
+// size of the OTLP request next to the size of the same histograms encoded as
+// native histogram protobuf (as exposed for scraping). Delta data points are
+// accumulated per series (see seriesKey), so that the native histogram is
+// always cumulative.
+type Receiver struct {
+	mtx        sync.Mutex
+	cumulative map[string]*native.Histogram // By seriesKey.
+
+	requests, points      int
+	otlpBytes, protoBytes int
+}
+
+// NewReceiver returns a ready-to-use Receiver.
+func NewReceiver() *Receiver {
+	return &Receiver{cumulative: map[string]*native.Histogram{}}
+}
+
+func (rcv *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := pmetricotlp.NewExportRequest()
+	if err := req.UnmarshalProto(body); err != nil {
+		log.Println("Could not decode OTLP request:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+
+	points, protoBytes := 0, 0
+	rms := req.Metrics().ResourceMetrics()
+	for i := 0; i < rms.Len(); i++ {
+		res := rms.At(i).Resource().Attributes()
+		sms := rms.At(i).ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			scope := sms.At(j).Scope()
+			ms := sms.At(j).Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				m := ms.At(k)
+				if m.Type() != pmetric.MetricTypeExponentialHistogram {
+					continue
+				}
+				eh := m.ExponentialHistogram()
+				for l := 0; l < eh.DataPoints().Len(); l++ {
+					dp := eh.DataPoints().At(l)
+					key := seriesKey(res, scope, m.Name(), dp.Attributes())
+					h := rcv.accumulate(key, ToNative(dp), eh.AggregationTemporality())
+					buf, err := proto.Marshal(h.Encode())
+					if err != nil {
+						log.Println("Could not encode native histogram:", err)
+						continue
+					}
+					points++
+					protoBytes += len(buf)
+				}
+			}
+		}
+	}
+
+	rcv.requests++
+	rcv.points += points
+	rcv.otlpBytes += len(body)
+	rcv.protoBytes += protoBytes
+	log.Printf(
+		"Received OTLP request: %d exponential histograms, %d bytes (%d bytes as native histogram protobuf). Total: %d requests, %.1f OTLP bytes vs. %.1f native bytes per histogram.",
+		points, len(body), protoBytes,
+		rcv.requests, float64(rcv.otlpBytes)/float64(rcv.points), float64(rcv.protoBytes)/float64(rcv.points),
+	)
+
+	resp, err := pmetricotlp.NewExportResponse().MarshalProto()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(resp)
+}
+
+// accumulate returns the cumulative histogram for h, a data point of the series
+// identified by key. For cumulative temporality, that's h itself.
+func (rcv *Receiver) accumulate(key string, h *native.Histogram, temporality pmetric.AggregationTemporality) *native.Histogram {
+	if temporality == pmetric.AggregationTemporalityDelta {
+		if prev, ok := rcv.cumulative[key]; ok {
+			h = native.Add(prev, h)
+		}
+	}
+	rcv.cumulative[key] = h
+	return h
+}
+
+// seriesKey identifies the series of a data point by the attributes of its
+// resource, its instrumentation scope, the name of its metric, and its own
+// attributes. (fmt prints maps sorted by key, so the key is stable.)
+func seriesKey(res pcommon.Map, scope pcommon.InstrumentationScope, name string, attrs pcommon.Map) string {
+	return fmt.Sprintf(
+		"%v %s/%s%v %s%v",
+		res.AsRaw(), scope.Name(), scope.Version(), scope.Attributes().AsRaw(), name, attrs.AsRaw(),
+	)
+}
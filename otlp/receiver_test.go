@@ -0,0 +1,64 @@
+package otlp
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+
+	"github.com/beorn7/histogram_experiments/native"
+)
+
+func TestReceiverAccumulatesPerSeries(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	// Each request has the same delta of one observation for each of
+	// four series of the same metric, differing in resource, scope, and
+	// data point attributes.
+	md := pmetric.NewMetrics()
+	for _, instance := range []string{"a", "b"} {
+		rm := md.ResourceMetrics().AppendEmpty()
+		rm.Resource().Attributes().PutStr("service.instance.id", instance)
+		for _, scope := range []string{"x", "y"} {
+			sm := rm.ScopeMetrics().AppendEmpty()
+			sm.Scope().SetName(scope)
+			m := sm.Metrics().AppendEmpty()
+			m.SetName("latency")
+			eh := m.SetEmptyExponentialHistogram()
+			eh.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+			for _, path := range []string{"/", "/api"} {
+				h := native.New(0, 0)
+				h.Count, h.Sum, h.Positive[1] = 1, 2, 1
+				dp := eh.DataPoints().AppendEmpty()
+				dp.Attributes().PutStr("path", path)
+				FromNative(h, dp)
+			}
+		}
+	}
+	body, err := pmetricotlp.NewExportRequestFromMetrics(md).MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcv := NewReceiver()
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		rcv.ServeHTTP(w, httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatalf("request %d: got status %d", i, w.Code)
+		}
+	}
+	if got, want := len(rcv.cumulative), 8; got != want {
+		t.Fatalf("got %d series, want %d", got, want)
+	}
+	for key, h := range rcv.cumulative {
+		if h.Count != 3 || h.Positive[1] != 3 {
+			t.Errorf("series %s: got count %g and bucket count %g, want 3 each", key, h.Count, h.Positive[1])
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/beorn7/histogram_experiments/block"
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The scraped histograms a sender is about to send via remote-write can be
+// shipped out of band to the receiver, so that the receiver can compare what
+// arrives with what was scraped. They are sent as metric families in the
+// length-delimited protobuf exposition format, with the time stamp of the
+// scrape set on each metric.
+
+var expectedFormat = expfmt.NewFormat(expfmt.TypeProtoDelim)
+
+// SendExpected sends the scraped metric families mfs to url. Each metric must
+// have its time stamp set.
+func SendExpected(client *http.Client, url string, mfs []*dto.MetricFamily) error {
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expectedFormat)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	resp, err := client.Post(url, string(expectedFormat), &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// DecodeExpected decodes a request sent by SendExpected and returns the
+// Samples that the native parts of the contained histograms would result in.
+func DecodeExpected(r *http.Request) ([]Sample, error) {
+	var (
+		dec     = expfmt.NewDecoder(r.Body, expectedFormat)
+		samples []Sample
+	)
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetHistogram() == nil || m.TimestampMs == nil {
+				return nil, fmt.Errorf("metric of family %s is not a histogram with time stamp", mf.GetName())
+			}
+			lset := block.Labels(mf.GetName(), m.GetLabel())
+			ih, fh := native.ToModel(m.GetHistogram())
+			samples = append(samples, Sample{Labels: lset, Timestamp: m.GetTimestampMs(), H: ih, FH: fh})
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Package remote encodes and decodes Prometheus remote-write requests (protocol
+// versions 1.0 and 2.0) carrying native histogram samples.
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Supported versions of the remote-write protocol.
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+const (
+	versionHeader   = "X-Prometheus-Remote-Write-Version"
+	contentTypeV1   = "application/x-protobuf"
+	contentTypeV2   = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+	histogramsV2Hdr = "X-Prometheus-Remote-Write-Histograms-Written"
+)
+
+// Sample is a native histogram sample of a series. Exactly one of H and FH is
+// set.
+type Sample struct {
+	Labels    labels.Labels
+	Timestamp int64 // In milliseconds, as usual within Prometheus.
+	H         *histogram.Histogram
+	FH        *histogram.FloatHistogram
+}
+
+// NewSample returns the Sample for the native part of a scraped histogram.
+func NewSample(lset labels.Labels, ts time.Time, h *dto.Histogram) Sample {
+	ih, fh := native.ToModel(h)
+	return Sample{Labels: lset, Timestamp: ts.UnixMilli(), H: ih, FH: fh}
+}
+
+// Equal returns true if both Samples are identical.
+func (s Sample) Equal(o Sample) bool {
+	if !labels.Equal(s.Labels, o.Labels) || s.Timestamp != o.Timestamp {
+		return false
+	}
+	if s.H != nil {
+		return o.H != nil && s.H.Equals(o.H)
+	}
+	return o.FH != nil && s.FH.Equals(o.FH)
+}
+
+// Stats describes the size of a remote-write request.
+type Stats struct {
+	Samples                  int
+	Compressed, Uncompressed int
+}
+
+// BytesPerSample returns the compressed bytes per sample.
+func (s Stats) BytesPerSample() float64 {
+	return float64(s.Compressed) / float64(s.Samples)
+}
+
+// Encode returns the snappy-compressed body of a remote-write request with the
+// given samples in the given protocol version, together with its Stats.
+func Encode(version int, samples []Sample) ([]byte, Stats, error) {
+	var (
+		buf []byte
+		err error
+	)
+	switch version {
+	case Version1:
+		buf, err = encodeV1(samples)
+	case Version2:
+		buf, err = encodeV2(samples)
+	default:
+		err = fmt.Errorf("unsupported remote-write version %d", version)
+	}
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	body := snappy.Encode(nil, buf)
+	return body, Stats{Samples: len(samples), Compressed: len(body), Uncompressed: len(buf)}, nil
+}
+
+func encodeV1(samples []Sample) ([]byte, error) {
+	req := prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(samples))}
+	for _, s := range samples {
+		var h prompb.Histogram
+		if s.H != nil {
+			h = prompb.FromIntHistogram(s.Timestamp, s.H)
+		} else {
+			h = prompb.FromFloatHistogram(s.Timestamp, s.FH)
+		}
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:     prompb.FromLabels(s.Labels, nil),
+			Histograms: []prompb.Histogram{h},
+		})
+	}
+	return req.Marshal()
+}
+
+func encodeV2(samples []Sample) ([]byte, error) {
+	var (
+		symbols = writev2.NewSymbolTable()
+		series  = make([]writev2.TimeSeries, 0, len(samples))
+	)
+	for _, s := range samples {
+		var h writev2.Histogram
+		if s.H != nil {
+			h = writev2.FromIntHistogram(s.Timestamp, s.H)
+		} else {
+			h = writev2.FromFloatHistogram(s.Timestamp, s.FH)
+		}
+		series = append(series, writev2.TimeSeries{
+			LabelsRefs: symbols.SymbolizeLabels(s.Labels, nil),
+			Histograms: []writev2.Histogram{h},
+			Metadata:   writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_HISTOGRAM},
+		})
+	}
+	req := writev2.Request{Symbols: symbols.Symbols(), Timeseries: series}
+	return req.Marshal()
+}
+
+// Decode decodes the snappy-compressed body of a remote-write request of the
+// given protocol version. Only histogram samples are returned, float samples
+// are ignored.
+func Decode(version int, body []byte) ([]Sample, Stats, error) {
+	buf, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, Stats{}, fmt.Errorf("snappy: %w", err)
+	}
+	var samples []Sample
+	switch version {
+	case Version1:
+		samples, err = decodeV1(buf)
+	case Version2:
+		samples, err = decodeV2(buf)
+	default:
+		err = fmt.Errorf("unsupported remote-write version %d", version)
+	}
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	return samples, Stats{Samples: len(samples), Compressed: len(body), Uncompressed: len(buf)}, nil
+}
+
+func decodeV1(buf []byte) ([]Sample, error) {
+	var (
+		req prompb.WriteRequest
+		b   labels.ScratchBuilder
+	)
+	if err := req.Unmarshal(buf); err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for _, ts := range req.Timeseries {
+		lset := ts.ToLabels(&b, nil)
+		for _, h := range ts.Histograms {
+			s := Sample{Labels: lset, Timestamp: h.Timestamp}
+			if h.IsFloatHistogram() {
+				s.FH = h.ToFloatHistogram()
+			} else {
+				s.H = h.ToIntHistogram()
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+func decodeV2(buf []byte) ([]Sample, error) {
+	var (
+		req writev2.Request
+		b   labels.ScratchBuilder
+	)
+	if err := req.Unmarshal(buf); err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for _, ts := range req.Timeseries {
+		lset := ts.ToLabels(&b, req.Symbols)
+		for _, h := range ts.Histograms {
+			s := Sample{Labels: lset, Timestamp: h.Timestamp}
+			if h.IsFloatHistogram() {
+				s.FH = h.ToFloatHistogram()
+			} else {
+				s.H = h.ToIntHistogram()
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+// Send sends the samples as a remote-write request of the given protocol
+// version to url.
+func Send(client *http.Client, url string, version int, samples []Sample) (Stats, error) {
+	body, stats, err := Encode(version, samples)
+	if err != nil {
+		return stats, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return stats, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	if version == Version2 {
+		req.Header.Set("Content-Type", contentTypeV2)
+		req.Header.Set(versionHeader, "2.0.0")
+	} else {
+		req.Header.Set("Content-Type", contentTypeV1)
+		req.Header.Set(versionHeader, "0.1.0")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return stats, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return stats, nil
+}
+
+// DecodeRequest decodes an incoming remote-write request, detecting the
+// protocol version from its Content-Type header.
+func DecodeRequest(r *http.Request) ([]Sample, int, Stats, error) {
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "snappy" {
+		return nil, 0, Stats{}, fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+	version := Version1
+	ct := r.Header.Get("Content-Type")
+	switch {
+	case ct == "" || ct == contentTypeV1 || strings.Contains(ct, "proto=prometheus.WriteRequest"):
+	case strings.Contains(ct, "proto=io.prometheus.write.v2.Request"):
+		version = Version2
+	default:
+		return nil, 0, Stats{}, fmt.Errorf("unsupported Content-Type %q", ct)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, version, Stats{}, err
+	}
+	if len(body) == 0 {
+		return nil, version, Stats{}, errors.New("empty request body")
+	}
+	samples, stats, err := Decode(version, body)
+	return samples, version, stats, err
+}
+
+// SetWrittenHeader sets the response header reporting the number of written
+// histogram samples, as required by remote-write 2.0.
+func SetWrittenHeader(w http.ResponseWriter, n int) {
+	w.Header().Set(histogramsV2Hdr, fmt.Sprint(n))
+}
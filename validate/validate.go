@@ -0,0 +1,149 @@
+// Package validate checks native histograms in the protobuf exposition format
+// for conformance. Unlike decoding, which gives up at the first problem,
+// validation reports every problem found, each with a diagnostic precise
+// enough to locate it in the message.
+package validate
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/beorn7/histogram_experiments/native"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Problem is a single conformance problem of a histogram.
+type Problem struct {
+	Field string // E.g. "positive_span[2]" or "zero_threshold".
+	Msg   string
+}
+
+func (p Problem) Error() string {
+	return p.Field + ": " + p.Msg
+}
+
+// Histogram returns all problems found in the native part of h. It never
+// panics, no matter how malformed h is. The following is checked:
+//   - The schema is within the range supported by Prometheus.
+//   - The zero threshold is neither NaN nor negative.
+//   - Integer deltas and float counts are not both used.
+//   - Spans have a non-zero length.
+//   - Spans after the first one have a non-zero offset (otherwise, they
+//     should have been merged with the previous span).
+//   - The spans describe as many buckets as there are deltas (or counts).
+//   - No absolute bucket count is negative (or NaN).
+//   - The bucket counts (including the zero bucket) add up to the sample
+//     count. If the sum is NaN, NaN observations might have happened, which
+//     are counted but not put into any bucket, so the sample count might be
+//     larger in that case.
+func Histogram(h *dto.Histogram) []Problem {
+	var ps []Problem
+	add := func(field, format string, args ...any) {
+		ps = append(ps, Problem{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if s := h.GetSchema(); s < native.MinSchema || s > native.MaxSchema {
+		add("schema", "%d out of range [%d, %d]", s, native.MinSchema, native.MaxSchema)
+	}
+	switch t := h.GetZeroThreshold(); {
+	case math.IsNaN(t):
+		add("zero_threshold", "is NaN")
+	case t < 0:
+		add("zero_threshold", "%g is negative", t)
+	}
+
+	isFloat := h.SampleCountFloat != nil || h.ZeroCountFloat != nil ||
+		len(h.GetPositiveCount()) > 0 || len(h.GetNegativeCount()) > 0
+	if isFloat && (h.SampleCount != nil || h.ZeroCount != nil ||
+		len(h.GetPositiveDelta()) > 0 || len(h.GetNegativeDelta()) > 0) {
+		add("histogram", "mixes integer and float counts")
+	}
+
+	var count, zeroCount float64
+	if isFloat {
+		count, zeroCount = h.GetSampleCountFloat(), h.GetZeroCountFloat()
+		switch {
+		case math.IsNaN(zeroCount):
+			add("zero_count_float", "is NaN")
+		case zeroCount < 0:
+			add("zero_count_float", "%g is negative", zeroCount)
+		}
+	} else {
+		count, zeroCount = float64(h.GetSampleCount()), float64(h.GetZeroCount())
+	}
+
+	total := zeroCount
+	total += buckets("positive", h.GetPositiveSpan(), h.GetPositiveDelta(), h.GetPositiveCount(), add)
+	total += buckets("negative", h.GetNegativeSpan(), h.GetNegativeDelta(), h.GetNegativeCount(), add)
+
+	countField := "sample_count"
+	if isFloat {
+		countField = "sample_count_float"
+	}
+	switch {
+	case math.IsNaN(h.GetSampleSum()) && count < total:
+		add(countField, "%g is smaller than the %g observations in buckets (including the zero bucket)", count, total)
+	case !math.IsNaN(h.GetSampleSum()) && count != total:
+		add(countField, "%g does not match the %g observations in buckets (including the zero bucket)", count, total)
+	}
+	return ps
+}
+
+// buckets checks the spans and bucket counts of one sign and returns the sum
+// of all valid absolute bucket counts.
+func buckets(
+	sign string, spans []*dto.BucketSpan, deltas []int64, counts []float64,
+	add func(field, format string, args ...any),
+) float64 {
+	n := 0
+	for i, span := range spans {
+		field := fmt.Sprintf("%s_span[%d]", sign, i)
+		if span.GetLength() == 0 {
+			add(field, "has zero length")
+		}
+		if i > 0 && span.GetOffset() == 0 {
+			add(field, "has zero offset, should be merged with the previous span")
+		}
+		n += int(span.GetLength())
+	}
+
+	var (
+		total    float64
+		idx      int64 // Avoids overflow in case of huge indices.
+		pos      int
+		absCount int64
+	)
+	nCounts, field := len(deltas), sign+"_delta"
+	if len(counts) > 0 {
+		nCounts, field = len(counts), sign+"_count"
+	}
+	if n != nCounts {
+		add(field, "has %d entries, but the %s spans describe %d buckets", nCounts, sign, n)
+	}
+	for _, span := range spans {
+		idx += int64(span.GetOffset())
+		for end := idx + int64(span.GetLength()); idx < end && pos < nCounts; idx++ {
+			var c float64
+			if len(counts) > 0 {
+				c = counts[pos]
+			} else {
+				absCount += deltas[pos]
+				c = float64(absCount)
+			}
+			switch {
+			case math.IsNaN(c):
+				add(fmt.Sprintf("%s[%d]", field, pos), "bucket with index %d has a NaN count", idx)
+			case c < 0:
+				add(fmt.Sprintf("%s[%d]", field, pos), "bucket with index %d has a negative count of %g", idx, c)
+			default:
+				total += c
+			}
+			if idx > math.MaxInt32 || idx < math.MinInt32 {
+				add(fmt.Sprintf("%s[%d]", field, pos), "bucket index %d overflows int32", idx)
+			}
+			pos++
+		}
+	}
+	return total
+}
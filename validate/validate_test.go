@@ -0,0 +1,165 @@
+package validate
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// validHistogram returns a conforming histogram with 9 observations: 1 in the
+// zero bucket, 5 in three positive buckets (in two spans), and 3 in one
+// negative bucket.
+func validHistogram() *dto.Histogram {
+	return &dto.Histogram{
+		SampleCount:   proto.Uint64(9),
+		SampleSum:     proto.Float64(10),
+		Schema:        proto.Int32(0),
+		ZeroThreshold: proto.Float64(0.001),
+		ZeroCount:     proto.Uint64(1),
+		PositiveSpan: []*dto.BucketSpan{
+			{Offset: proto.Int32(0), Length: proto.Uint32(2)},
+			{Offset: proto.Int32(2), Length: proto.Uint32(1)},
+		},
+		PositiveDelta: []int64{2, -1, 1},
+		NegativeSpan:  []*dto.BucketSpan{{Offset: proto.Int32(-1), Length: proto.Uint32(1)}},
+		NegativeDelta: []int64{3},
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		modify func(h *dto.Histogram)
+		want   []Problem
+	}{
+		{
+			name:   "valid",
+			modify: func(*dto.Histogram) {},
+		},
+		{
+			name: "more deltas than described by spans",
+			modify: func(h *dto.Histogram) {
+				h.PositiveDelta = append(h.PositiveDelta, 0)
+			},
+			want: []Problem{
+				{"positive_delta", "has 4 entries, but the positive spans describe 3 buckets"},
+			},
+		},
+		{
+			name: "fewer deltas than described by spans",
+			modify: func(h *dto.Histogram) {
+				h.PositiveSpan[1].Length = proto.Uint32(3)
+			},
+			want: []Problem{
+				{"positive_delta", "has 3 entries, but the positive spans describe 5 buckets"},
+			},
+		},
+		{
+			name: "negative bucket count",
+			modify: func(h *dto.Histogram) {
+				// Absolute counts 2, -1, 1. The negative count is
+				// not added to the observations in buckets.
+				h.PositiveDelta = []int64{2, -3, 2}
+				h.SampleCount = proto.Uint64(7)
+			},
+			want: []Problem{
+				{"positive_delta[1]", "bucket with index 1 has a negative count of -1"},
+			},
+		},
+		{
+			name: "negative float bucket count",
+			modify: func(h *dto.Histogram) {
+				h.SampleCount, h.ZeroCount = nil, nil
+				h.SampleCountFloat, h.ZeroCountFloat = proto.Float64(9), proto.Float64(1)
+				h.PositiveDelta, h.PositiveCount = nil, []float64{2, 1, 2}
+				h.NegativeDelta, h.NegativeCount = nil, []float64{-3}
+			},
+			want: []Problem{
+				{"negative_count[0]", "bucket with index -1 has a negative count of -3"},
+				{"sample_count_float", "9 does not match the 6 observations in buckets (including the zero bucket)"},
+			},
+		},
+		{
+			name: "schema too large",
+			modify: func(h *dto.Histogram) {
+				h.Schema = proto.Int32(9)
+			},
+			want: []Problem{{"schema", "9 out of range [-4, 8]"}},
+		},
+		{
+			name: "schema too small",
+			modify: func(h *dto.Histogram) {
+				h.Schema = proto.Int32(-5)
+			},
+			want: []Problem{{"schema", "-5 out of range [-4, 8]"}},
+		},
+		{
+			name: "count does not match bucket sum",
+			modify: func(h *dto.Histogram) {
+				h.SampleCount = proto.Uint64(10)
+			},
+			want: []Problem{
+				{"sample_count", "10 does not match the 9 observations in buckets (including the zero bucket)"},
+			},
+		},
+		{
+			name: "count larger than bucket sum with NaN sum",
+			modify: func(h *dto.Histogram) {
+				h.SampleCount = proto.Uint64(10)
+				h.SampleSum = proto.Float64(math.NaN())
+			},
+		},
+		{
+			name: "count smaller than bucket sum with NaN sum",
+			modify: func(h *dto.Histogram) {
+				h.SampleCount = proto.Uint64(8)
+				h.SampleSum = proto.Float64(math.NaN())
+			},
+			want: []Problem{
+				{"sample_count", "8 is smaller than the 9 observations in buckets (including the zero bucket)"},
+			},
+		},
+		{
+			name: "zero length and zero offset spans",
+			modify: func(h *dto.Histogram) {
+				h.PositiveSpan = append(h.PositiveSpan, &dto.BucketSpan{Offset: proto.Int32(0), Length: proto.Uint32(0)})
+			},
+			want: []Problem{
+				{"positive_span[2]", "has zero length"},
+				{"positive_span[2]", "has zero offset, should be merged with the previous span"},
+			},
+		},
+		{
+			name: "negative zero threshold",
+			modify: func(h *dto.Histogram) {
+				h.ZeroThreshold = proto.Float64(-1)
+			},
+			want: []Problem{{"zero_threshold", "-1 is negative"}},
+		},
+		{
+			name: "mixed integer and float counts",
+			modify: func(h *dto.Histogram) {
+				h.SampleCountFloat = proto.Float64(9)
+			},
+			want: []Problem{
+				{"histogram", "mixes integer and float counts"},
+				// The zero count is taken from the (missing) float
+				// field, the bucket counts from the deltas.
+				{"sample_count_float", "9 does not match the 8 observations in buckets (including the zero bucket)"},
+			},
+		},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			h := validHistogram()
+			s.modify(h)
+			if got := Histogram(h); !reflect.DeepEqual(got, s.want) {
+				t.Errorf("got problems %q, want %q", got, s.want)
+			}
+		})
+	}
+}